@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"regexp"
@@ -10,9 +11,8 @@ import (
 )
 
 var (
-	pattern_pkgver = regexp.MustCompile(`^pkgver=(.*)$`)
+	pattern_assignment = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
 	pattern_pkgrel = regexp.MustCompile(`^pkgrel=(.*)$`)
-	pattern_depends = regexp.MustCompile(`^depends="(.*)"$`)
 	pattern_apkname = regexp.MustCompile(`^([A-Za-z0-9._-]+)-([0-9]+\.[0-9]+(\.[0-9]+)?(\.[0-9]+)?-r[0-9]+)\.apk$`)
 )
 
@@ -37,63 +37,314 @@ func find_apkbuild(pkg *Package, directory string) error {
 }
 
 // Parse an APKBUILD file. Given an existing Package, add core information
-// (Version, Dependencies) as it is identified.
+// (Version, Dependencies, Sources, Checksums) as it is identified.
 func parse_apkbuild(pkg *Package, filename string) error {
-	pkgver := ""
-	pkgrel := ""
-	depends := []string{}
-	inside_depends := false
+	variables, err := parse_apkbuild_variables(filename)
+	if (err != nil) {
+		return err
+	}
+
+	pkgver := variables["pkgver"]
+	pkgrel := variables["pkgrel"]
+	if (pkgver == "") || (pkgrel == "") {
+		return fmt.Errorf("APKBUILD is incomplete in %s", pkg.Name)
+	}
+	pkg.Version = pkgver + "-r" + pkgrel
 
+	depends := strings.Fields(variables["depends"])
+	if (len(depends) != 0) {
+		pkg.Dependencies = depends
+	}
+
+	pkg.Sources = strings.Fields(variables["source"])
+	pkg.Checksums = parse_checksums(variables["sha512sums"])
+	pkg.Variables = variables
+
+	return nil
+}
+
+// Parse the variables assigned at the top level of an APKBUILD file. Values
+// can be quoted and span multiple lines. References to variables are
+// expanded, unless the value is single-quoted.
+func parse_apkbuild_variables(filename string) (map[string]string, error) {
 	file, err := os.Open(filename)
 	if (err != nil) {
-		return err
+		return nil, err
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	return parse_variables(file, filename)
+}
+
+// Parse the variables assigned at the top level of APKBUILD content. See
+// parse_apkbuild_variables.
+func parse_variables(r io.Reader, filename string) (map[string]string, error) {
+	variables := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		line := scanner.Text()
-
-		match := pattern_pkgver.FindStringSubmatch(line)
-		if (match != nil) {
-			pkgver = match[1]
-		}
-		match = pattern_pkgrel.FindStringSubmatch(line)
-		if (match != nil) {
-			pkgrel = match[1]
-		}
-		
-		if (inside_depends == true) {
-			if (line == "\"") {
-				inside_depends = false
-			} else {
-				depends = append(depends, parse_list(line)...)
+		match := pattern_assignment.FindStringSubmatch(scanner.Text())
+		if (match == nil) {
+			continue
+		}
+		name, value := match[1], match[2]
+
+		if (value == "") {
+			variables[name] = ""
+			continue
+		}
+
+		quote := value[0:1]
+		if (quote != "\"") && (quote != "'") {
+			value, _, _ = strings.Cut(value, "#")
+			variables[name] = expand_variables(strings.TrimSpace(value), variables)
+			continue
+		}
+
+		// Read until the closing quote, which might be on a later line.
+		value = value[1:]
+		lines := []string{}
+		for {
+			i := strings.Index(value, quote)
+			if (i != -1) {
+				lines = append(lines, value[:i])
+				break
 			}
-		} else if (line == "depends=\"") {
-			inside_depends = true
+			lines = append(lines, value)
+
+			if (scanner.Scan() == false) {
+				return nil, fmt.Errorf("Unterminated value of %s in %s", name, filename)
+			}
+			value = scanner.Text()
 		}
 
-		match = pattern_depends.FindStringSubmatch(line)
-		if (match != nil) {
-			depends = append(depends, parse_list(match[1])...)
+		value = strings.Join(lines, "\n")
+		if (quote == "\"") {
+			value = expand_variables(value, variables)
 		}
+		variables[name] = value
 	}
 
-	err = scanner.Err()
+	err := scanner.Err()
+	if (err != nil) {
+		return nil, err
+	}
+
+	return variables, nil
+}
+
+// Expand references to variables, like `$pkgver` or `${pkgver}`. The shell
+// parameter expansions `${var%pattern}`, `${var%%pattern}`, `${var#pattern}`,
+// `${var##pattern}`, `${var/pattern/string}` and `${var//pattern/string}` are
+// supported as well.
+func expand_variables(value string, variables map[string]string) string {
+	return os.Expand(value, func(reference string) string {
+		i := strings.IndexAny(reference, "%#/")
+		if (i == -1) {
+			return variables[reference]
+		}
+
+		name, op, pattern := reference[:i], reference[i:i + 1], reference[i + 1:]
+		value := variables[name]
+		greedy := (strings.HasPrefix(pattern, op) == true)
+		if (greedy == true) {
+			pattern = pattern[1:]
+		}
+
+		switch op {
+		case "%":
+			return trim_pattern(value, pattern, greedy, false)
+		case "#":
+			return trim_pattern(value, pattern, greedy, true)
+		default:
+			pattern, replacement, _ := strings.Cut(pattern, "/")
+			return replace_pattern(value, pattern, replacement, greedy)
+		}
+	})
+}
+
+// Compile a shell glob pattern, as used in parameter expansions. Unlike
+// path.Match, `*` and `?` also match `/`.
+func compile_pattern(pattern string) (*regexp.Regexp, error) {
+	expr := "^"
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr += "(?s:.*)"
+		case '?':
+			expr += "(?s:.)"
+		case '\\':
+			if (i + 1 < len(pattern)) {
+				i++
+			}
+			expr += regexp.QuoteMeta(pattern[i:i + 1])
+		case '[':
+			end := strings.Index(pattern[i + 1:], "]")
+			if (end == -1) {
+				return nil, fmt.Errorf("Unterminated bracket in %s", pattern)
+			}
+			class := pattern[i + 1:i + 1 + end]
+			i += end + 1
+			if (strings.HasPrefix(class, "!") == true) {
+				class = "^" + class[1:]
+			}
+			expr += "[" + strings.ReplaceAll(class, "\\", "\\\\") + "]"
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	return regexp.Compile(expr + "$")
+}
+
+// Remove the shortest (or longest, if greedy) prefix or suffix of a value that
+// matches a glob pattern.
+func trim_pattern(value, pattern string, greedy, prefix bool) string {
+	matcher, err := compile_pattern(pattern)
+	if (err != nil) {
+		return value
+	}
+
+	best := -1
+	for i := 0; i <= len(value); i++ {
+		candidate := value[i:]
+		if (prefix == true) {
+			candidate = value[:i]
+		}
+
+		if (matcher.MatchString(candidate) == false) {
+			continue
+		}
+
+		// For prefixes, i grows with the match; for suffixes, it shrinks.
+		if (best == -1) || (greedy == prefix) {
+			best = i
+		}
+		if (greedy != prefix) {
+			break
+		}
+	}
+
+	if (best == -1) {
+		return value
+	} else if (prefix == true) {
+		return value[best:]
+	}
+	return value[:best]
+}
+
+// Replace the first (or every, if greedy) substring of a value that matches a
+// glob pattern.
+func replace_pattern(value, pattern, replacement string, greedy bool) string {
+	matcher, err := compile_pattern(pattern)
+	if (err != nil) {
+		return value
+	}
+
+	result := ""
+	for i := 0; i < len(value); {
+		end := -1
+		for j := len(value); i < j; j-- {
+			if (matcher.MatchString(value[i:j]) == true) {
+				end = j
+				break
+			}
+		}
+
+		if (end == -1) {
+			result += value[i:i + 1]
+			i++
+			continue
+		}
+
+		result += replacement
+		if (greedy == false) {
+			return result + value[end:]
+		}
+		i = end
+	}
+	return result
+}
+
+// Parse a `sha512sums=` value. Each line is a checksum and a filename.
+func parse_checksums(value string) map[string]string {
+	checksums := map[string]string{}
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if (len(fields) == 2) {
+			checksums[fields[1]] = fields[0]
+		}
+	}
+	return checksums
+}
+
+// Rewrite the pkgrel of an APKBUILD file to match the Package Version.
+func write_pkgrel(pkg Package) error {
+	version := strings.SplitN(pkg.Version, "-r", 2)
+	if (len(version) != 2) {
+		return fmt.Errorf("Cannot identify pkgrel in %s", pkg.Version)
+	}
+
+	filename := path.Join(pkg.Path, "APKBUILD")
+	content, err := os.ReadFile(filename)
 	if (err != nil) {
 		return err
 	}
 
-	if (pkgver == "") || (pkgrel == "") {
-		return fmt.Errorf("APKBUILD is incomplete in %s", pkg.Name)
+	lines := strings.Split(string(content), "\n")
+	found := false
+	for i, line := range lines {
+		if (pattern_pkgrel.MatchString(line) == true) {
+			lines[i] = "pkgrel=" + version[1]
+			found = true
+		}
 	}
-	pkg.Version = pkgver + "-r" + pkgrel
 
-	if (len(depends) != 0) {
-		pkg.Dependencies = depends
+	if (found == false) {
+		return fmt.Errorf("No pkgrel in APKBUILD for %s", pkg.Name)
 	}
 
-	return nil
+	return os.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// Rewrite the `sha512sums=` of an APKBUILD file. If there is none, it is
+// appended.
+func write_checksums(pkg Package, lines []string) error {
+	filename := path.Join(pkg.Path, "APKBUILD")
+	content, err := os.ReadFile(filename)
+	if (err != nil) {
+		return err
+	}
+
+	block := "sha512sums=\"\n" + strings.Join(lines, "\n") + "\n\""
+
+	old := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	rewritten := []string{}
+	found := false
+	for i := 0; i < len(old); i++ {
+		if (strings.HasPrefix(old[i], "sha512sums=") == false) {
+			rewritten = append(rewritten, old[i])
+			continue
+		}
+
+		// Skip the rest of the old value, which might span multiple lines.
+		value := strings.TrimPrefix(old[i], "sha512sums=")
+		if (strings.HasPrefix(value, "\"") == true) || (strings.HasPrefix(value, "'") == true) {
+			quote := value[0:1]
+			if (strings.Contains(value[1:], quote) == false) {
+				for i++; (i < len(old)) && (strings.Contains(old[i], quote) == false); i++ {
+				}
+			}
+		}
+
+		rewritten = append(rewritten, block)
+		found = true
+	}
+
+	if (found == false) {
+		rewritten = append(rewritten, "", block)
+	}
+
+	return os.WriteFile(filename, []byte(strings.Join(rewritten, "\n") + "\n"), 0644)
 }
 
 // Scan a filename for an apk file. If one is identified, create a Package to
@@ -106,12 +357,20 @@ func find_apk(filename string) (Package, error) {
 	return Package{}, fmt.Errorf("Could not identify apk in %s", filename)
 }
 
-// Construct the local directory expected to be built into.
-func expected_apkdir(local_dir, arch string) string {
+// Translate an architecture to the name used by apk.
+func apk_architecture(arch string) string {
 	if (arch == "amd64") {
-		return path.Join(local_dir, "x86_64")
+		return "x86_64"
 	} else if (arch == "arm64") {
-		return path.Join(local_dir, "aarch64")
+		return "aarch64"
+	}
+	return arch
+}
+
+// Construct the local directory expected to be built into.
+func expected_apkdir(local_dir, arch string) string {
+	if (arch == "amd64") || (arch == "arm64") {
+		return path.Join(local_dir, apk_architecture(arch))
 	}
 	return local_dir
 }
@@ -121,26 +380,12 @@ func expected_apk(pkg Package) string {
 	return fmt.Sprintf("%s-%s.apk", pkg.Name, pkg.Version)
 }
 
-// Reconstruct the relevant parts of the APKBUILD files that were parsed.
-func dump_apkbuilds(packages []Package, debug_prefix string) {
+// Log the relevant parts of the APKBUILD files that were parsed.
+func dump_apkbuilds(packages []Package, subsystem string) {
+	log := logger(subsystem)
 	total := len(packages)
 	for i, p := range packages {
-		version := strings.SplitN(p.Version, "-r", 2)
-		fmt.Printf("DEBUG-APK:[%d/%d] %s\n", i + 1, total, p.Name)
-		fmt.Printf("DEBUG-APK:pkgver=%s\n", version[0])
-		fmt.Printf("DEBUG-APK:pkgrel=%s\n", version[1])
-		has_dependencies := (0 < len(p.Dependencies))
-		print_if(has_dependencies, "DEBUG-APK:depends=\"")
-		for _, d := range p.Dependencies {
-			fmt.Printf("DEBUG-APK:\t%s\n", d)
-		}
-		print_if(has_dependencies, "DEBUG-APK:\"")
-		fmt.Println("DEBUG-APK:")
+		pkgver, pkgrel, _ := strings.Cut(p.Version, "-r")
+		log.Debug("Package", "index", i + 1, "total", total, "name", p.Name, "pkgver", pkgver, "pkgrel", pkgrel, "depends", p.Dependencies)
 	}
 }
-
-// Parse a string as a whitespace-delimited list.
-func parse_list(list string) []string {
-	return strings.Split(strings.TrimSpace(list), " ")
-}
-
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseApkbuildVariables(t *testing.T) {
+	content := strings.Join([]string{
+		`# Maintainer: Nobody <nobody@example.com>`,
+		`pkgname=foo`,
+		`pkgver=1.2.3 # the upstream version`,
+		`pkgrel=0`,
+		`_major=${pkgver%%.*}`,
+		`url="https://example.com/$pkgname"`,
+		`depends=""`,
+		`literal='$pkgname'`,
+		`source="$pkgname-$pkgver.tar.gz::https://example.com/$pkgname-$pkgver.tar.gz`,
+		`	local.patch`,
+		`	"`,
+		`empty=`,
+		``,
+		`build() {`,
+		`	inner=ignored`,
+		`}`,
+	}, "\n")
+
+	filename := path.Join(t.TempDir(), "APKBUILD")
+	err := os.WriteFile(filename, []byte(content), 0644)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	variables, err := parse_apkbuild_variables(filename)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"pkgname", "foo"},
+		{"pkgver", "1.2.3"},
+		{"pkgrel", "0"},
+		{"_major", "1"},
+		{"url", "https://example.com/foo"},
+		{"depends", ""},
+		{"literal", "$pkgname"},
+		{"source", "foo-1.2.3.tar.gz::https://example.com/foo-1.2.3.tar.gz\n\tlocal.patch\n\t"},
+		{"empty", ""},
+	}
+	for _, test := range tests {
+		got, ok := variables[test.name]
+		if (ok == false) {
+			t.Errorf("%s: not parsed", test.name)
+		} else if (got != test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	_, ok := variables["inner"]
+	if (ok == true) {
+		t.Errorf("inner: parsed from a function body")
+	}
+}
+
+func TestParseApkbuildVariablesUnterminated(t *testing.T) {
+	filename := path.Join(t.TempDir(), "APKBUILD")
+	err := os.WriteFile(filename, []byte("pkgname=foo\nsource=\"foo.tar.gz\n"), 0644)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	_, err = parse_apkbuild_variables(filename)
+	if (err == nil) {
+		t.Errorf("expected an error for an unterminated value")
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+	variables := map[string]string{
+		"pkgname": "foo",
+		"pkgver": "1.2.3_rc1",
+		"url": "https://example.com/a/b/c",
+	}
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"$pkgname", "foo"},
+		{"${pkgname}-${pkgver}", "foo-1.2.3_rc1"},
+		{"$missing", ""},
+		{"${pkgver%.*}", "1.2"},
+		{"${pkgver%%.*}", "1"},
+		{"${pkgver#*.}", "2.3_rc1"},
+		{"${pkgver##*.}", "3_rc1"},
+		{"${pkgver%_rc*}", "1.2.3"},
+		{"${pkgver/./_}", "1_2.3_rc1"},
+		{"${pkgver//./_}", "1_2_3_rc1"},
+		{"${pkgver/_rc/}", "1.2.31"},
+		{"${url##*/}", "c"},
+		{"${url%/*}", "https://example.com/a/b"},
+		{"${pkgver%x}", "1.2.3_rc1"},
+	}
+	for _, test := range tests {
+		got := expand_variables(test.value, variables)
+		if (got != test.want) {
+			t.Errorf("%s: got %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestTrimPattern(t *testing.T) {
+	tests := []struct {
+		value   string
+		pattern string
+		greedy  bool
+		prefix  bool
+		want    string
+	}{
+		{"a.b.c", "*.", false, true, "b.c"},
+		{"a.b.c", "*.", true, true, "c"},
+		{"a.b.c", ".*", false, false, "a.b"},
+		{"a.b.c", ".*", true, false, "a"},
+		{"a.b.c", "x*", false, true, "a.b.c"},
+		{"a.b.c", "*x", true, false, "a.b.c"},
+		{"a.b.c", "*", false, true, "a.b.c"},
+		{"a.b.c", "*", true, true, ""},
+		{"a.b.c", "*", false, false, "a.b.c"},
+		{"a.b.c", "*", true, false, ""},
+		{"", "*", true, true, ""},
+		{"a.b.c", "[", true, true, "a.b.c"},
+		{"a/b/c", "*/", true, true, "c"},
+		{"a/b/c", "/?", false, false, "a/b"},
+		{"v1.2", "[!0-9]", false, true, "1.2"},
+		{"a*b", "a\\*", false, true, "b"},
+	}
+	for _, test := range tests {
+		got := trim_pattern(test.value, test.pattern, test.greedy, test.prefix)
+		if (got != test.want) {
+			t.Errorf("trim_pattern(%q, %q, %t, %t): got %q, want %q", test.value, test.pattern, test.greedy, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestReplacePattern(t *testing.T) {
+	tests := []struct {
+		value       string
+		pattern     string
+		replacement string
+		greedy      bool
+		want        string
+	}{
+		{"a.b.c", ".", "_", false, "a_b.c"},
+		{"a.b.c", ".", "_", true, "a_b_c"},
+		{"a.b.c", "b", "", false, "a..c"},
+		{"a.b.c", "x", "_", true, "a.b.c"},
+		{"a.b.c", ".*", "", false, "a"},
+		{"aaa", "a", "bb", true, "bbbbbb"},
+		{"foo-1.2", "[0-9]", "N", true, "foo-N.N"},
+		{"a/b/c", "/", "-", true, "a-b-c"},
+		{"a/b/c", "a/*/", "", false, "c"},
+		{"", "a", "b", true, ""},
+	}
+	for _, test := range tests {
+		got := replace_pattern(test.value, test.pattern, test.replacement, test.greedy)
+		if (got != test.want) {
+			t.Errorf("replace_pattern(%q, %q, %q, %t): got %q, want %q", test.value, test.pattern, test.replacement, test.greedy, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IndexEntry stores the information about a package in an APKINDEX.
+type IndexEntry struct {
+	Checksum string
+	Name     string
+	Version  string
+	Arch     string
+	Size     int64
+	Depends  []string
+	Provides []string
+	Raw      string
+}
+
+// IndexMember stores a file from an APKINDEX.tar.gz or apk file.
+type IndexMember struct {
+	Header *tar.Header
+	Data   []byte
+}
+
+// Read an APKINDEX.tar.gz file.
+func read_apkindex(filename string) ([]IndexEntry, error) {
+	members, err := read_archive_members(filename)
+	if (err != nil) {
+		return nil, err
+	}
+
+	for _, member := range members {
+		if (member.Header.Name == "APKINDEX") {
+			return parse_apkindex(bytes.NewReader(member.Data))
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not an index: no APKINDEX", filename)
+}
+
+// Read the files from an APKINDEX.tar.gz or apk file. Both are a
+// concatenation of gzip streams (an optional signature, then the content). The
+// signature is skipped.
+func read_archive_members(filename string) ([]IndexMember, error) {
+	members := []IndexMember{}
+
+	content, err := os.ReadFile(filename)
+	if (err != nil) {
+		return nil, err
+	}
+
+	reader := bytes.NewReader(content)
+	gz, err := gzip.NewReader(reader)
+	if (err != nil) {
+		return nil, fmt.Errorf("Cannot read %s: %s", filename, err)
+	}
+	defer gz.Close()
+
+	for {
+		gz.Multistream(false)
+
+		archive := tar.NewReader(gz)
+		for {
+			header, err := archive.Next()
+			if (err == io.EOF) {
+				break
+			} else if (err != nil) {
+				return nil, fmt.Errorf("Cannot read %s: %s", filename, err)
+			}
+
+			if (strings.HasPrefix(header.Name, ".SIGN.") == true) {
+				continue
+			}
+
+			data, err := io.ReadAll(archive)
+			if (err != nil) {
+				return nil, err
+			}
+			members = append(members, IndexMember{header, data})
+		}
+
+		_, err = io.Copy(io.Discard, gz)
+		if (err != nil) {
+			return nil, err
+		}
+
+		err = gz.Reset(reader)
+		if (err == io.EOF) {
+			break
+		} else if (err != nil) {
+			return nil, fmt.Errorf("Cannot read %s: %s", filename, err)
+		}
+	}
+
+	return members, nil
+}
+
+// Rewrite an APKINDEX.tar.gz file, keeping only some entries. If a private key
+// is given, the new index is signed like `abuild-sign(1)` would.
+func rewrite_apkindex(in_name, out_name string, keep func(IndexEntry) bool, key_name string) error {
+	members, err := read_archive_members(in_name)
+	if (err != nil) {
+		return err
+	}
+
+	var index bytes.Buffer
+	gz := gzip.NewWriter(&index)
+	archive := tar.NewWriter(gz)
+
+	for _, member := range members {
+		if (member.Header.Name == "APKINDEX") {
+			entries, err := parse_apkindex(bytes.NewReader(member.Data))
+			if (err != nil) {
+				return err
+			}
+
+			kept := []string{}
+			for _, entry := range entries {
+				if (keep(entry) == true) {
+					kept = append(kept, entry.Raw)
+				}
+			}
+			member.Data = []byte(strings.Join(kept, "\n") + "\n")
+			member.Header.Size = int64(len(member.Data))
+		}
+
+		err = archive.WriteHeader(member.Header)
+		if (err != nil) {
+			return err
+		}
+		_, err = archive.Write(member.Data)
+		if (err != nil) {
+			return err
+		}
+	}
+
+	err = archive.Close()
+	if (err != nil) {
+		return err
+	}
+	err = gz.Close()
+	if (err != nil) {
+		return err
+	}
+
+	content := index.Bytes()
+	if (key_name != "") {
+		signature, err := sign_index(content, key_name)
+		if (err != nil) {
+			return err
+		}
+		content = append(signature, content...)
+	}
+
+	return os.WriteFile(out_name, content, 0644)
+}
+
+// Sign an index with a private key. The signature segment is a gzip stream of a
+// tar archive (without an end of archive marker) containing a SHA1 RSA
+// signature, named for the public key that verifies it.
+func sign_index(content []byte, key_name string) ([]byte, error) {
+	pem_content, err := os.ReadFile(key_name)
+	if (err != nil) {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pem_content)
+	if (block == nil) {
+		return nil, fmt.Errorf("%s is not a PEM private key", key_name)
+	}
+
+	var key *rsa.PrivateKey
+	key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	if (err != nil) {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if (err != nil) {
+			return nil, fmt.Errorf("%s is not an RSA private key: %s", key_name, err)
+		}
+		ok := false
+		key, ok = parsed.(*rsa.PrivateKey)
+		if (ok == false) {
+			return nil, fmt.Errorf("%s is not an RSA private key", key_name)
+		}
+	}
+
+	digest := sha1.Sum(content)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, digest[:])
+	if (err != nil) {
+		return nil, err
+	}
+
+	var segment bytes.Buffer
+	gz := gzip.NewWriter(&segment)
+	archive := tar.NewWriter(gz)
+
+	header := tar.Header{
+		Name: ".SIGN.RSA." + path.Base(key_name) + ".pub",
+		Mode: 0644,
+		Size: int64(len(signature)),
+		ModTime: time.Now(),
+		Format: tar.FormatUSTAR,
+	}
+	err = archive.WriteHeader(&header)
+	if (err != nil) {
+		return nil, err
+	}
+	_, err = archive.Write(signature)
+	if (err != nil) {
+		return nil, err
+	}
+
+	// Flush instead of Close, to omit the end of archive marker.
+	err = archive.Flush()
+	if (err != nil) {
+		return nil, err
+	}
+	err = gz.Close()
+	if (err != nil) {
+		return nil, err
+	}
+
+	return segment.Bytes(), nil
+}
+
+// Parse an APKINDEX file. Entries are blocks of `K:value` lines separated by
+// blank lines.
+func parse_apkindex(r io.Reader) ([]IndexEntry, error) {
+	entries := []IndexEntry{}
+	entry := IndexEntry{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if (line == "") {
+			if (entry.Name != "") {
+				entries = append(entries, entry)
+			}
+			entry = IndexEntry{}
+			continue
+		}
+		entry.Raw += line + "\n"
+
+		key, value, found := strings.Cut(line, ":")
+		if (found == false) {
+			return nil, fmt.Errorf("Failed to parse line of APKINDEX: %s", line)
+		}
+
+		switch key {
+		case "C":
+			entry.Checksum = value
+		case "P":
+			entry.Name = value
+		case "V":
+			entry.Version = value
+		case "A":
+			entry.Arch = value
+		case "S":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if (err != nil) {
+				return nil, err
+			}
+			entry.Size = size
+		case "D":
+			entry.Depends = strings.Fields(value)
+		case "p":
+			entry.Provides = strings.Fields(value)
+		}
+	}
+
+	err := scanner.Err()
+	if (err != nil) {
+		return nil, err
+	}
+
+	if (entry.Name != "") {
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Construct the apk filename corresponding to an IndexEntry.
+func (entry IndexEntry) filename() string {
+	return fmt.Sprintf("%s-%s.apk", entry.Name, entry.Version)
+}
+
+// Strip the version constraint from a dependency or provider name, e.g.
+// `so:libc.musl-x86_64.so.1=1` or `foo>=1.0`.
+func strip_constraint(name string) string {
+	i := strings.IndexAny(name, "<>=~")
+	if (i != -1) {
+		return name[:i]
+	}
+	return name
+}
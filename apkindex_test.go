@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+const test_apkindex = `C:Q1p8cs7WmXIm1bHNqmXwDYiTbLHJU=
+P:foo
+V:1.2.3-r0
+A:x86_64
+S:1024
+D:bar>=2.0 so:libc.musl-x86_64.so.1 !baz
+p:cmd:foo=1.2.3-r0
+
+C:Q1dOVbHdkd7GTCKVi3lbHHOB6hGCo=
+P:bar
+V:2.1.3-r0
+A:x86_64
+S:2048
+p:so:libbar.so.2=2.1.3
+
+C:Q1Ld3lDbMDPuIYn7mnB8Q2bC6q+Zc=
+P:bar
+V:2.0.0-r0
+A:x86_64
+S:2000
+`
+
+// Write an unsigned APKINDEX.tar.gz file.
+func write_apkindex(t *testing.T, index string) string {
+	filename := path.Join(t.TempDir(), "APKINDEX.tar.gz")
+	content := build_segment(t, []IndexMember{segment_member("DESCRIPTION", "test repository"), segment_member("APKINDEX", index)}, true)
+	err := os.WriteFile(filename, content, 0644)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadApkindex(t *testing.T) {
+	entries, err := read_apkindex(write_apkindex(t, test_apkindex))
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	if (len(entries) != 3) {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+
+	foo := entries[0]
+	if (foo.Checksum != "Q1p8cs7WmXIm1bHNqmXwDYiTbLHJU=") || (foo.Name != "foo") || (foo.Version != "1.2.3-r0") || (foo.Arch != "x86_64") || (foo.Size != 1024) {
+		t.Errorf("got %+v", foo)
+	}
+	if (reflect.DeepEqual(foo.Depends, []string{"bar>=2.0", "so:libc.musl-x86_64.so.1", "!baz"}) == false) {
+		t.Errorf("got depends %q", foo.Depends)
+	}
+	if (reflect.DeepEqual(entries[1].Provides, []string{"so:libbar.so.2=2.1.3"}) == false) {
+		t.Errorf("got provides %q", entries[1].Provides)
+	}
+	if (entries[2].filename() != "bar-2.0.0-r0.apk") {
+		t.Errorf("got filename %s", entries[2].filename())
+	}
+}
+
+func TestReadApkindexInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"not gzip", []byte("not an index")},
+		{"no APKINDEX", build_segment(t, []IndexMember{segment_member("DESCRIPTION", "test repository")}, true)},
+		{"bad line", build_segment(t, []IndexMember{segment_member("APKINDEX", "P:foo\nnot a line\n")}, true)},
+		{"bad size", build_segment(t, []IndexMember{segment_member("APKINDEX", "P:foo\nS:large\n")}, true)},
+	}
+	for _, test := range tests {
+		filename := path.Join(t.TempDir(), "APKINDEX.tar.gz")
+		err := os.WriteFile(filename, test.content, 0644)
+		if (err != nil) {
+			t.Fatal(err)
+		}
+
+		_, err = read_apkindex(filename)
+		if (err == nil) {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestReadArchiveMembersSkipsSignature(t *testing.T) {
+	signature := build_segment(t, []IndexMember{segment_member(".SIGN.RSA.me.rsa.pub", "signature")}, false)
+	index := build_segment(t, []IndexMember{segment_member("DESCRIPTION", "test repository"), segment_member("APKINDEX", test_apkindex)}, true)
+
+	filename := path.Join(t.TempDir(), "APKINDEX.tar.gz")
+	err := os.WriteFile(filename, bytes.Join([][]byte{signature, index}, nil), 0644)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	members, err := read_archive_members(filename)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, member := range members {
+		names = append(names, member.Header.Name)
+	}
+	if (reflect.DeepEqual(names, []string{"DESCRIPTION", "APKINDEX"}) == false) {
+		t.Errorf("got members %q", names)
+	}
+}
+
+func TestStripConstraint(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"foo", "foo"},
+		{"foo>=1.0", "foo"},
+		{"foo<2", "foo"},
+		{"foo~1.2", "foo"},
+		{"so:libc.musl-x86_64.so.1=1", "so:libc.musl-x86_64.so.1"},
+	}
+	for _, test := range tests {
+		got := strip_constraint(test.name)
+		if (got != test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// Write a new RSA private key like `abuild-keygen(1)`.
+func write_signing_key(t *testing.T) (string, *rsa.PublicKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	key_name := path.Join(t.TempDir(), "me.rsa")
+	block := pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	err = os.WriteFile(key_name, pem.EncodeToMemory(&block), 0600)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	return key_name, &key.PublicKey
+}
+
+// Split a signed APKINDEX.tar.gz file into the signature and the signed
+// content.
+func split_signature(t *testing.T, content []byte) (*tar.Header, []byte, []byte) {
+	reader := bytes.NewReader(content)
+	gz, err := gzip.NewReader(reader)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	gz.Multistream(false)
+
+	archive := tar.NewReader(gz)
+	header, err := archive.Next()
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	signature, err := io.ReadAll(archive)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(io.Discard, gz)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	return header, signature, content[len(content) - reader.Len():]
+}
+
+func TestRewriteApkindex(t *testing.T) {
+	key_name, public_key := write_signing_key(t)
+	in_name := write_apkindex(t, test_apkindex)
+	out_name := path.Join(t.TempDir(), "APKINDEX.tar.gz")
+
+	keep := func(entry IndexEntry) bool {
+		return (entry.filename() != "bar-2.0.0-r0.apk")
+	}
+	err := rewrite_apkindex(in_name, out_name, keep, key_name)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	entries, err := read_apkindex(out_name)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	filenames := []string{}
+	for _, entry := range entries {
+		filenames = append(filenames, entry.filename())
+	}
+	if (reflect.DeepEqual(filenames, []string{"foo-1.2.3-r0.apk", "bar-2.1.3-r0.apk"}) == false) {
+		t.Errorf("got %q", filenames)
+	}
+	if (reflect.DeepEqual(entries[0].Depends, []string{"bar>=2.0", "so:libc.musl-x86_64.so.1", "!baz"}) == false) {
+		t.Errorf("got depends %q after rewriting", entries[0].Depends)
+	}
+
+	members, err := read_archive_members(out_name)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	if (len(members) != 2) || (members[0].Header.Name != "DESCRIPTION") || (string(members[0].Data) != "test repository") {
+		t.Errorf("DESCRIPTION was not kept")
+	}
+
+	content, err := os.ReadFile(out_name)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	header, signature, signed := split_signature(t, content)
+	if (header.Name != ".SIGN.RSA.me.rsa.pub") {
+		t.Errorf("got signature %s, want .SIGN.RSA.me.rsa.pub", header.Name)
+	}
+	digest := sha1.Sum(signed)
+	err = rsa.VerifyPKCS1v15(public_key, crypto.SHA1, digest[:], signature)
+	if (err != nil) {
+		t.Errorf("signature does not verify: %s", err)
+	}
+}
+
+func TestRewriteApkindexUnsigned(t *testing.T) {
+	in_name := write_apkindex(t, test_apkindex)
+	out_name := path.Join(t.TempDir(), "APKINDEX.tar.gz")
+
+	keep := func(entry IndexEntry) bool {
+		return true
+	}
+	err := rewrite_apkindex(in_name, out_name, keep, "")
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(out_name)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	header, _, _ := split_signature(t, content)
+	if (header.Name != "DESCRIPTION") {
+		t.Errorf("got %s as the first member, want no signature", header.Name)
+	}
+}
+
+func TestSignIndexInvalidKey(t *testing.T) {
+	key_name := path.Join(t.TempDir(), "me.rsa")
+	err := os.WriteFile(key_name, []byte("not a key"), 0600)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	_, err = sign_index([]byte("index"), key_name)
+	if (err == nil) {
+		t.Errorf("expected an error for an invalid key")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Artifact stores the contents of a built apk file.
+//
+// An apk file is a concatenation of gzip streams, each a tar archive: an
+// optional signature segment, the control segment (containing `.PKGINFO`), and
+// the data segment. The checksum of the control segment is what identifies a
+// package in an APKINDEX.
+type Artifact struct {
+	Signatures []string
+	Info       map[string][]string
+	Checksum   string
+}
+
+// Read an apk file.
+func read_artifact(filename string) (Artifact, error) {
+	artifact := Artifact{[]string{}, map[string][]string{}, ""}
+
+	content, err := os.ReadFile(filename)
+	if (err != nil) {
+		return artifact, err
+	}
+
+	reader := bytes.NewReader(content)
+	gz, err := gzip.NewReader(reader)
+	if (err != nil) {
+		return artifact, fmt.Errorf("%s is not an apk: %s", filename, err)
+	}
+	defer gz.Close()
+
+	has_info := false
+	start := 0
+	for {
+		gz.Multistream(false)
+		is_control := false
+
+		archive := tar.NewReader(gz)
+		for {
+			header, err := archive.Next()
+			if (err == io.EOF) {
+				break
+			} else if (err != nil) {
+				return artifact, fmt.Errorf("%s is not an apk: %s", filename, err)
+			}
+
+			if (strings.HasPrefix(header.Name, ".SIGN.") == true) {
+				artifact.Signatures = append(artifact.Signatures, header.Name)
+			} else if (header.Name == ".PKGINFO") {
+				artifact.Info, err = parse_pkginfo(archive)
+				if (err != nil) {
+					return artifact, err
+				}
+				has_info = true
+				is_control = true
+			}
+		}
+
+		// Drain the stream (i.e. the end of archive marker, if any)
+		_, err = io.Copy(io.Discard, gz)
+		if (err != nil) {
+			return artifact, err
+		}
+
+		end := len(content) - reader.Len()
+		if (is_control == true) {
+			artifact.Checksum = index_checksum(content[start:end])
+		}
+		start = end
+
+		err = gz.Reset(reader)
+		if (err == io.EOF) {
+			break
+		} else if (err != nil) {
+			return artifact, fmt.Errorf("%s is not an apk: %s", filename, err)
+		}
+	}
+
+	if (has_info == false) {
+		return artifact, fmt.Errorf("%s is not an apk: no .PKGINFO", filename)
+	}
+
+	return artifact, nil
+}
+
+// Compute a checksum as used in an APKINDEX. It is a SHA1 digest that is base64
+// encoded and prefixed with `Q1`.
+func index_checksum(content []byte) string {
+	digest := sha1.Sum(content)
+	return "Q1" + base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// Parse a `.PKGINFO` file. Keys like `depend` can be repeated.
+func parse_pkginfo(r io.Reader) (map[string][]string, error) {
+	info := map[string][]string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if (strings.HasPrefix(line, "#") == true) {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, " = ")
+		if (found == true) {
+			info[key] = append(info[key], value)
+		}
+	}
+
+	return info, scanner.Err()
+}
+
+// Get the first value of a `.PKGINFO` key.
+func (artifact Artifact) get(key string) string {
+	values := artifact.Info[key]
+	if (len(values) == 0) {
+		return ""
+	}
+	return values[0]
+}
+
+// Check an apk file against the Package it should contain and the target
+// architecture. Returns a list of problems.
+func check_artifact(pkg Package, arch, filename string) []string {
+	artifact, err := read_artifact(filename)
+	if (err != nil) {
+		return []string{err.Error()}
+	}
+
+	problems := []string{}
+
+	pkgname := artifact.get("pkgname")
+	if (pkgname != pkg.Name) {
+		problems = append(problems, fmt.Sprintf("pkgname is %s, expected %s", pkgname, pkg.Name))
+	}
+
+	pkgver := artifact.get("pkgver")
+	if (pkgver != pkg.Version) {
+		problems = append(problems, fmt.Sprintf("pkgver is %s, expected %s", pkgver, pkg.Version))
+	}
+
+	apk_arch := artifact.get("arch")
+	if (apk_arch != apk_architecture(arch)) && (apk_arch != "noarch") {
+		problems = append(problems, fmt.Sprintf("arch is %s, expected %s", apk_arch, apk_architecture(arch)))
+	}
+
+	if (len(artifact.Signatures) == 0) {
+		problems = append(problems, "not signed")
+	}
+
+	return problems
+}
+
+// Verify a built Package before it is pushed. Problems are reported, and
+// cause an error.
+func verify_artifact(pkg Package, arch, local_dir string) error {
+	filename := path.Join(local_dir, expected_apk(pkg))
+	logger("artifact").Debug("Verifying", "file", filename)
+
+	problems := check_artifact(pkg, arch, filename)
+	if (len(problems) == 0) {
+		return nil
+	}
+
+	fmt.Printf("Verification of %s %s failed:\n", pkg.Name, pkg.Version)
+	for _, problem := range problems {
+		fmt.Printf("  %s\n", problem)
+	}
+
+	return errors.New("Refusing to push " + expected_apk(pkg))
+}
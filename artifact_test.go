@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Build a segment of an apk or APKINDEX.tar.gz file: a gzip stream of a tar
+// archive. The signature segment has no end of archive marker.
+func build_segment(t *testing.T, members []IndexMember, marker bool) []byte {
+	var segment bytes.Buffer
+	gz := gzip.NewWriter(&segment)
+	archive := tar.NewWriter(gz)
+
+	for _, member := range members {
+		err := archive.WriteHeader(member.Header)
+		if (err != nil) {
+			t.Fatal(err)
+		}
+		_, err = archive.Write(member.Data)
+		if (err != nil) {
+			t.Fatal(err)
+		}
+	}
+
+	var err error
+	if (marker == true) {
+		err = archive.Close()
+	} else {
+		err = archive.Flush()
+	}
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	err = gz.Close()
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	return segment.Bytes()
+}
+
+// Construct a member of a segment.
+func segment_member(name, content string) IndexMember {
+	header := tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(content)),
+		ModTime: time.Date(2024, 3, 2, 14, 3, 11, 0, time.UTC),
+		Format: tar.FormatUSTAR,
+	}
+	return IndexMember{&header, []byte(content)}
+}
+
+// Build the segments of an apk file with a `.PKGINFO`.
+func build_apk(t *testing.T, pkginfo string, signed bool) (signature, control, data []byte) {
+	if (signed == true) {
+		signature = build_segment(t, []IndexMember{segment_member(".SIGN.RSA.me.rsa.pub", "signature")}, false)
+	}
+	control = build_segment(t, []IndexMember{segment_member(".PKGINFO", pkginfo)}, true)
+	data = build_segment(t, []IndexMember{segment_member("usr/bin/foo", "#!/bin/sh\n")}, true)
+	return signature, control, data
+}
+
+func write_apk(t *testing.T, segments ...[]byte) string {
+	filename := path.Join(t.TempDir(), "foo-1.2.3-r0.apk")
+	err := os.WriteFile(filename, bytes.Join(segments, nil), 0644)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+const test_pkginfo = "# Generated by abuild\npkgname = foo\npkgver = 1.2.3-r0\narch = x86_64\ndepend = so:libc.musl-x86_64.so.1\ndepend = bar\n"
+
+func TestReadArtifact(t *testing.T) {
+	signature, control, data := build_apk(t, test_pkginfo, true)
+
+	artifact, err := read_artifact(write_apk(t, signature, control, data))
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	if (artifact.get("pkgname") != "foo") || (artifact.get("pkgver") != "1.2.3-r0") || (artifact.get("arch") != "x86_64") {
+		t.Errorf("got %v", artifact.Info)
+	}
+	if (strings.Join(artifact.Info["depend"], " ") != "so:libc.musl-x86_64.so.1 bar") {
+		t.Errorf("got depends %q", artifact.Info["depend"])
+	}
+	if (artifact.get("missing") != "") {
+		t.Errorf("got %q for a missing key", artifact.get("missing"))
+	}
+	if (len(artifact.Signatures) != 1) || (artifact.Signatures[0] != ".SIGN.RSA.me.rsa.pub") {
+		t.Errorf("got signatures %q", artifact.Signatures)
+	}
+
+	// Only the control segment is checksummed.
+	if (artifact.Checksum != index_checksum(control)) {
+		t.Errorf("got checksum %s, want %s", artifact.Checksum, index_checksum(control))
+	}
+}
+
+func TestReadArtifactInvalid(t *testing.T) {
+	_, _, data := build_apk(t, test_pkginfo, false)
+
+	tests := []struct {
+		name     string
+		segments [][]byte
+	}{
+		{"not gzip", [][]byte{[]byte("not an apk")}},
+		{"no .PKGINFO", [][]byte{data}},
+	}
+	for _, test := range tests {
+		_, err := read_artifact(write_apk(t, test.segments...))
+		if (err == nil) {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestCheckArtifact(t *testing.T) {
+	pkg := new_package_with_version("foo", "1.2.3-r0")
+
+	tests := []struct {
+		name    string
+		pkginfo string
+		signed  bool
+		arch    string
+		want    []string
+	}{
+		{"valid", test_pkginfo, true, "amd64", []string{}},
+		{"noarch", "pkgname = foo\npkgver = 1.2.3-r0\narch = noarch\n", true, "arm64", []string{}},
+		{"pkgname", "pkgname = bar\npkgver = 1.2.3-r0\narch = x86_64\n", true, "amd64", []string{"pkgname is bar, expected foo"}},
+		{"pkgver", "pkgname = foo\npkgver = 1.2.3-r1\narch = x86_64\n", true, "amd64", []string{"pkgver is 1.2.3-r1, expected 1.2.3-r0"}},
+		{"arch", test_pkginfo, true, "arm64", []string{"arch is x86_64, expected aarch64"}},
+		{"unsigned", test_pkginfo, false, "amd64", []string{"not signed"}},
+	}
+	for _, test := range tests {
+		signature, control, data := build_apk(t, test.pkginfo, test.signed)
+		problems := check_artifact(pkg, test.arch, write_apk(t, signature, control, data))
+		if (strings.Join(problems, "\n") != strings.Join(test.want, "\n")) {
+			t.Errorf("%s: got %q, want %q", test.name, problems, test.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Audit a repository. The listing is compared to the APKINDEX: apks missing
+// from the index, index entries with no apk, and size mismatches are reported.
+// Optionally, every apk is fetched to compare checksums as well. Multiple
+// versions of the same package are also reported. Dependencies that cannot be
+// satisfied within the repository are returned separately as warnings, since
+// they may be satisfied by another repository (e.g. Alpine's main).
+func audit_repository(remote_dir string, checksums bool) ([]string, []string, error) {
+	problems := []string{}
+	warnings := []string{}
+
+	files, err := fetch_remote_files(remote_dir)
+	if (err != nil) {
+		return nil, nil, err
+	}
+
+	apks := map[string]RemoteFile{}
+	versions := map[string][]string{}
+	has_index := false
+	for _, file := range files {
+		if (file.Name == "APKINDEX.tar.gz") {
+			has_index = true
+		} else if (strings.HasSuffix(file.Name, ".apk") == true) {
+			apks[file.Name] = file
+			pkg, err := find_apk(file.Name)
+			if (err != nil) {
+				problems = append(problems, err.Error())
+				continue
+			}
+			versions[pkg.Name] = append(versions[pkg.Name], pkg.Version)
+		}
+	}
+
+	names := []string{}
+	for name, _ := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if (1 < len(versions[name])) {
+			problems = append(problems, fmt.Sprintf("%s has multiple versions: %s", name, strings.Join(versions[name], ", ")))
+		}
+	}
+
+	if (has_index == false) {
+		problems = append(problems, "APKINDEX.tar.gz is missing")
+		return problems, warnings, nil
+	}
+
+	tmp, err := os.MkdirTemp("", "simple-builder-")
+	if (err != nil) {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	err = fetch_file(remote_dir, "APKINDEX.tar.gz", tmp)
+	if (err != nil) {
+		return nil, nil, err
+	}
+
+	entries, err := read_apkindex(path.Join(tmp, "APKINDEX.tar.gz"))
+	if (err != nil) {
+		return nil, nil, err
+	}
+
+	indexed := map[string]bool{}
+	provided := map[string]bool{}
+	for _, entry := range entries {
+		indexed[entry.filename()] = true
+		provided[entry.Name] = true
+		for _, p := range entry.Provides {
+			provided[strip_constraint(p)] = true
+		}
+	}
+
+	for _, file := range files {
+		if (strings.HasSuffix(file.Name, ".apk") == true) && (indexed[file.Name] == false) {
+			problems = append(problems, fmt.Sprintf("%s is missing from the index", file.Name))
+		}
+	}
+
+	for _, entry := range entries {
+		file, ok := apks[entry.filename()]
+		if (ok == false) {
+			problems = append(problems, fmt.Sprintf("%s is in the index but does not exist", entry.filename()))
+			continue
+		}
+
+		if (file.Size != entry.Size) {
+			problems = append(problems, fmt.Sprintf("%s is %d bytes but the index has %d", file.Name, file.Size, entry.Size))
+		}
+
+		if (checksums == true) {
+			err = fetch_file(remote_dir, file.Name, tmp)
+			if (err != nil) {
+				return nil, nil, err
+			}
+
+			artifact, err := read_artifact(path.Join(tmp, file.Name))
+			if (err != nil) {
+				problems = append(problems, err.Error())
+			} else if (artifact.Checksum != entry.Checksum) {
+				problems = append(problems, fmt.Sprintf("%s has checksum %s but the index has %s", file.Name, artifact.Checksum, entry.Checksum))
+			}
+
+			os.Remove(path.Join(tmp, file.Name))
+		}
+
+		for _, dep := range entry.Depends {
+			// Conflicts and providers (e.g. `so:libc.musl-x86_64.so.1`) can't
+			// be checked against a single repository.
+			if (strings.HasPrefix(dep, "!") == true) || (strings.Contains(dep, ":") == true) {
+				continue
+			}
+			if (provided[strip_constraint(dep)] == false) {
+				warnings = append(warnings, fmt.Sprintf("%s depends on %s which is not in the repository", entry.filename(), dep))
+			}
+		}
+	}
+
+	return problems, warnings, nil
+}
@@ -1,19 +1,39 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
+	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// Clean up -source SRCDIR.
-func clean_source(srcdir string) string {
-	src, err := filepath.Abs(srcdir)
-	if (err != nil) {
-		panic(err)
+// Clean up -source SRCDIRS.
+func clean_source(srcdirs string) []string {
+	srcs := []string{}
+	for _, srcdir := range strings.Split(srcdirs, ",") {
+		srcdir = strings.TrimSpace(srcdir)
+		if (srcdir == "") {
+			continue
+		}
+
+		src, err := filepath.Abs(srcdir)
+		if (err != nil) {
+			panic(err)
+		}
+		srcs = append(srcs, src)
+	}
+
+	if (len(srcs) == 0) {
+		panic("No package source directory")
 	}
-	return src
+	return srcs
 }
 
 // Clean up -destination PKGDIR
@@ -25,8 +45,35 @@ func clean_destination(pkgdir string) string {
 	return dest
 }
 
+// Clean up -state STATEDIR
+func clean_state(statedir string) string {
+	state, err := filepath.Abs(statedir)
+	if (err != nil) {
+		panic(err)
+	}
+	return state
+}
+
+// Clean up -distfiles DISTDIR
+func clean_distfiles(distdir string) string {
+	dist, err := filepath.Abs(distdir)
+	if (err != nil) {
+		panic(err)
+	}
+	return dist
+}
+
 // Clean up -repository CONNECTION
 func clean_repository(connection string) string {
+	repo, err := parse_repository(connection)
+	if (err != nil) {
+		panic(err)
+	}
+	return repo
+}
+
+// Parse a connection string to a repository.
+func parse_repository(connection string) (string, error) {
 	repo := strings.TrimSpace(connection)
 
 	// To obtain a directory listing, the connection string must end in a
@@ -37,28 +84,547 @@ func clean_repository(connection string) string {
 
 	pattern, err := regexp.Compile(`^(([A-Za-z0-9][A-Za-z0-9._-]*@)?([A-Za-z0-9._-]+):)?(/[A-Za-z0-9._-]+)+/$`)
 	if (err != nil) {
-		panic(err)
+		return "", err
 	}
 	match := pattern.FindStringSubmatch(repo)
 	if (match == nil) || (match[4] == "") {
-		panic(fmt.Sprintf("Connection string %s seems invalid", repo))
+		return "", fmt.Errorf("Connection string %s seems invalid", repo)
 	}
 
-	return repo
+	return repo, nil
+}
+
+// Clean up -section-repository SECTION=CONNECTION,...
+func clean_sections(list string) map[string]string {
+	sections := map[string]string{}
+	for _, mapping := range strings.Split(list, ",") {
+		mapping = strings.TrimSpace(mapping)
+		if (mapping == "") {
+			continue
+		}
+
+		section, connection, found := strings.Cut(mapping, "=")
+		if (found == false) || (section == "") {
+			panic(fmt.Sprintf("Section mapping %s seems invalid", mapping))
+		}
+		sections[section] = clean_repository(connection)
+	}
+	return sections
 }
 
 // Clean up -arch ARCH
 func clean_architecture(arch, repo string) string {
+	arch, err := parse_architecture(arch, repo)
+	if (err != nil) {
+		panic(err)
+	}
+	return arch
+}
+
+// Parse an architecture, or detect it from a repository.
+func parse_architecture(arch, repo string) (string, error) {
 	if (arch == "amd64" ) || (arch == "arm64") {
-		return arch
+		return arch, nil
 	}
 
 	if (strings.Contains(repo, "x86_64")) {
-		return "amd64"
+		return "amd64", nil
 	} else if (strings.Contains(repo, "aarch64")) {
-		return "arm64"
+		return "arm64", nil
+	}
+
+	return "", errors.New("Not a valid architecture")
+}
+
+
+// Clean up -sync MODE
+func clean_sync(mode string) string {
+	if (mode == "all") || (mode == "index") || (mode == "none") {
+		return mode
+	}
+	panic(fmt.Sprintf("Sync mode %s is not valid", mode))
+}
+
+// Clean up -source-date-epoch TIMESTAMP. Returns -1 if no timestamp was given.
+func clean_epoch(epoch string) int64 {
+	if (epoch == "") {
+		return -1
+	}
+
+	timestamp, err := strconv.ParseInt(epoch, 10, 64)
+	if (err != nil) || (timestamp < 0) {
+		panic(fmt.Sprintf("SOURCE_DATE_EPOCH %s is not valid", epoch))
+	}
+	return timestamp
+}
+
+// Clean up -pin-image [CONNECTION=]DIGEST,... Pins are keyed by target, since
+// the digest of an image can be for a single platform. A digest without a
+// connection string pins every repository.
+func clean_pins(list, arch string) map[string]string {
+	pattern := regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+	pins := map[string]string{}
+	for _, mapping := range strings.Split(list, ",") {
+		mapping = strings.TrimSpace(mapping)
+		if (mapping == "") {
+			continue
+		}
+
+		target := ""
+		connection, digest, found := strings.Cut(mapping, "=")
+		if (found == false) {
+			digest = mapping
+		} else {
+			target = target_name(clean_repository(connection), arch)
+		}
+		if (pattern.MatchString(digest) == false) {
+			panic(fmt.Sprintf("Image digest %s seems invalid", digest))
+		}
+		pins[target] = digest
+	}
+	return pins
+}
+
+// Clean up -image IMAGE, -pull POLICY, and -pin-image PINS
+func clean_image_options(image, pull, pins, arch string) ImageOptions {
+	if (pull != pull_always) && (pull != pull_if_missing) && (pull != pull_never) {
+		panic(fmt.Sprintf("Pull policy %s is not valid", pull))
+	}
+	if (strings.Contains(image, "@") == true) && (pins != "") {
+		panic("Cannot pin an image that is already referenced by digest")
+	}
+	return ImageOptions{strings.TrimSpace(image), pull, clean_pins(pins, arch)}
+}
+
+// Clean up -local-repository, -container-repository URLS, -public-key KEY,
+// -distfiles DISTDIR, the image options, and -cross
+func clean_build_options(local bool, urls, key, distdir string, image ImageOptions, cross bool) BuildOptions {
+	repositories := []string{}
+	if (local == true) {
+		repositories = append(repositories, container_repository)
+	}
+	for _, url := range strings.Split(urls, ",") {
+		url = strings.TrimSpace(url)
+		if (url != "") {
+			repositories = append(repositories, url)
+		}
+	}
+
+	// apk refuses an index that is signed with an unknown key, unless the
+	// image already trusts it.
+	if (local == true) && (key == "") {
+		logger("build").Warn("No -public-key given, so the image must already trust the signing key of the local repository")
+	}
+
+	if (key != "") {
+		abs, err := filepath.Abs(key)
+		if (err != nil) {
+			panic(err)
+		}
+		key = abs
+	}
+
+	if (distdir != "") {
+		distdir = clean_distfiles(distdir)
+	}
+
+	return BuildOptions{repositories, key, distdir, []string{}, image, cross, ""}
+}
+
+// Clean up -newer-than DATE
+func clean_date(date string) time.Time {
+	if (date == "") {
+		return time.Time{}
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if (err != nil) {
+		panic(fmt.Sprintf("Date %s seems invalid", date))
+	}
+	return t
+}
+
+// Clean up -signing-key KEY
+func clean_signing_key(key string) string {
+	if (key == "") {
+		return ""
+	}
+
+	abs, err := filepath.Abs(key)
+	if (err != nil) {
+		panic(err)
+	}
+	return abs
+}
+
+// Clean up -webhook-secret SECRETFILE, -webhook-sourcehut-key KEY, and
+// -webhook-ref REF
+func clean_webhook_options(secret_file, sourcehut_key, ref string) WebhookOptions {
+	opts := WebhookOptions{}
+
+	if (secret_file != "") {
+		secret, err := os.ReadFile(secret_file)
+		if (err != nil) {
+			panic(err)
+		}
+		opts.Secret = []byte(strings.TrimSpace(string(secret)))
+		if (len(opts.Secret) == 0) {
+			panic("Webhook secret is empty")
+		}
 	}
 
-	panic("Not a valid architecture")
+	if (sourcehut_key != "") {
+		key, err := base64.StdEncoding.DecodeString(sourcehut_key)
+		if (err != nil) || (len(key) != ed25519.PublicKeySize) {
+			panic("Invalid sourcehut key")
+		}
+		opts.SourcehutKey = ed25519.PublicKey(key)
+	}
+
+	ref = strings.TrimSpace(ref)
+	if (ref != "") && (strings.HasPrefix(ref, "refs/") == false) {
+		ref = "refs/heads/" + ref
+	}
+	opts.Ref = ref
+
+	return opts
+}
+
+// Clean up -api-token TOKENFILE. Without a token file, the webhook secret is
+// used. If neither is given, runs cannot be started through the API.
+func clean_api_token(token_file string, webhook WebhookOptions) []byte {
+	if (token_file == "") {
+		return webhook.Secret
+	}
+
+	token, err := os.ReadFile(token_file)
+	if (err != nil) {
+		panic(err)
+	}
+	token = []byte(strings.TrimSpace(string(token)))
+	if (len(token) == 0) {
+		panic("API token is empty")
+	}
+	return token
+}
+
+// Clean up -notify-email ADDRESSES, -smtp-server SERVER, -smtp-from ADDRESS,
+// -notify-webhook URL, -notify-exec COMMAND, and -notify-on EVENTS. The SMTP
+// credentials, if any, are read from SMTP_USERNAME and SMTP_PASSWORD.
+func clean_notify_options(emails, server, from, url, command, on string) NotifyOptions {
+	if (on != notify_all) && (on != notify_failure) {
+		panic(fmt.Sprintf("Notification events %s are not valid", on))
+	}
+	opts := NotifyOptions{[]Notifier{}, on}
+
+	to := clean_patterns(emails)
+	if (len(to) != 0) {
+		if (server == "") || (from == "") {
+			panic("Email notifications require -smtp-server and -smtp-from")
+		}
+		opts.Notifiers = append(opts.Notifiers, EmailNotifier{server, from, to, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD")})
+	}
+
+	if (url != "") {
+		opts.Notifiers = append(opts.Notifiers, WebhookNotifier{url})
+	}
+
+	if (command != "") {
+		// Commands without a separator are looked up in PATH when run.
+		if (strings.Contains(command, "/") == true) {
+			abs, err := filepath.Abs(command)
+			if (err != nil) {
+				panic(err)
+			}
+			command = abs
+		}
+		opts.Notifiers = append(opts.Notifiers, ExecNotifier{command})
+	}
+
+	return opts
+}
+
+// Clean up -only PATTERNS and -exclude PATTERNS
+func clean_patterns(list string) []string {
+	patterns := []string{}
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if (pattern != "") {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// Command stores a subcommand of the program.
+type Command struct {
+	Name        string
+	Arguments   string
+	Description string
+	Flags       func(flags *flag.FlagSet)
+	Run         func(args []string) error
+}
+
+var commands = []Command{
+	{"plan", "[package ...]", "Summarize packages to build", plan_flags, run_plan},
+	{"build", "[package ...]", "Build packages and push them to the repository", build_flags, run_build},
+	{"push", "[package ...]", "Push packages that were built but not pushed", build_flags, run_push},
+	{"list-local", "", "List package sources", source_flags, run_list_local},
+	{"list-remote", "", "List packages in the repository", repository_flags, run_list_remote},
+	{"graph", "", "Print the dependency graph of package sources in DOT format", source_flags, run_graph},
+	{"verify", "[package ...]", "Verify that packages to push were built correctly, or audit the repository", verify_flags, run_verify},
+	{"prune", "", "Remove superseded packages from the repository", prune_flags, run_prune},
+	{"clean", "", "Remove built packages from the destination", clean_flags, run_clean},
+	{"checksum", "package ...", "Update sha512sums of package sources", checksum_flags, run_checksum},
+	{"lint", "", "Check package sources for problems", lint_flags, run_lint},
+	{"reproduce", "[package ...]", "Check whether packages build reproducibly", reproduce_flags, run_reproduce},
+	{"history", "", "Query the history of runs", history_flags, run_history},
+	{"daemon", "[package ...]", "Build packages whenever package sources or the repository change", daemon_flags, run_daemon},
+}
+
+// Add flags shared by all commands.
+func common_flags(flags *flag.FlagSet) {
+	flags.BoolVar(&verbose, "verbose", false, "Show debugging messages (same as -log-level debug)")
+	flags.StringVar(&log_level, "log-level", "info", "Minimum level of messages to log (debug, info, warn, or error)")
+	flags.StringVar(&log_format, "log-format", "text", "Format of log messages (text or json)")
+}
+
+// Add flags for commands that read package sources.
+func source_flags(flags *flag.FlagSet) {
+	common_flags(flags)
+	flags.StringVar(&source, "source", "./src", "Comma-separated directories of package sources")
+	flags.IntVar(&depth, "depth", 1, "How deep to look for package sources in each directory")
+}
+
+// Add flags for commands that read the repository.
+func repository_flags(flags *flag.FlagSet) {
+	common_flags(flags)
+	flags.StringVar(&repository, "repository", "", "Connection string for the remote package repository")
 }
 
+// Add flags for commands that compare package sources to the repository.
+func plan_flags(flags *flag.FlagSet) {
+	source_flags(flags)
+	flags.StringVar(&repository, "repository", "", "Connection string for the remote package repository")
+	flags.StringVar(&sections, "section-repository", "", "Comma-separated SECTION=CONNECTION mappings of sections to remote package repositories")
+	flags.StringVar(&only, "only", "", "Comma-separated glob patterns of packages to build")
+	flags.StringVar(&exclude, "exclude", "", "Comma-separated glob patterns of packages to skip")
+	flags.BoolVar(&with_deps, "with-deps", false, "Also build out-of-date dependencies of selected packages")
+	flags.BoolVar(&with_rdeps, "with-rdeps", false, "Also build out-of-date reverse dependencies of selected packages")
+	flags.BoolVar(&force, "force", false, "Rebuild selected packages (or all) even if the repository is up to date")
+	flags.BoolVar(&bump_pkgrel, "bump-pkgrel", false, "Increment pkgrel for forced rebuilds")
+	flags.StringVar(&state_dir, "state", "./state", "Directory of build state files")
+	flags.StringVar(&changed_since, "changed-since", "", "Git ref (or last-success) to find changed package sources since")
+	flags.BoolVar(&changed_only, "changed-only", false, "Only build package sources that changed (requires -changed-since)")
+}
+
+// Add flags for commands that build or push packages.
+func build_flags(flags *flag.FlagSet) {
+	plan_flags(flags)
+	flags.StringVar(&destination, "destination", "./pkg", "Directory of packages")
+	flags.StringVar(&architecture, "architecture", "detected from repository", "architecture to build")
+	flags.BoolVar(&resume, "resume", false, "Push packages that were built by an interrupted run instead of rebuilding")
+	flags.BoolVar(&dry_run, "dry-run", false, "Print what would be built and pushed without building or pushing")
+	flags.StringVar(&sync_mode, "sync", "all", "Pull packages (all), only the index (index), or nothing (none) from the repository before building")
+	flags.BoolVar(&local_repository, "local-repository", true, "Use the destination as a repository inside build containers")
+	flags.StringVar(&container_repositories, "container-repository", "", "Comma-separated URLs of additional repositories to use inside build containers")
+	flags.StringVar(&public_key, "public-key", "", "Public key to install inside build containers")
+	flags.StringVar(&distfiles, "distfiles", "", "Directory to fetch and verify sources into before building (by default, build containers fetch sources)")
+	flags.StringVar(&image_name, "image", builder_image, "Image to create build containers from")
+	flags.StringVar(&pull_policy, "pull", pull_if_missing, "Pull the image before every build (always), only if it is not present (if-missing), or never (never)")
+	flags.StringVar(&pin_image, "pin-image", "", "Comma-separated [CONNECTION=]DIGEST pins of the image for each repository (or all)")
+	flags.BoolVar(&cross, "cross", false, "Cross-compile with abuild (CBUILD and CHOST) instead of emulating a foreign architecture (experimental)")
+	flags.StringVar(&notify_email, "notify-email", "", "Comma-separated email addresses to send results to")
+	flags.StringVar(&smtp_server, "smtp-server", "", "SMTP server (HOST:PORT) to send emails through")
+	flags.StringVar(&smtp_from, "smtp-from", "", "Address to send emails from")
+	flags.StringVar(&notify_webhook, "notify-webhook", "", "URL to POST results to as JSON")
+	flags.StringVar(&notify_exec, "notify-exec", "", "Command to run for each result, with the result in environment variables")
+	flags.StringVar(&notify_on, "notify-on", "failure", "Send notifications of every result (all) or only of failures (failure)")
+}
+
+// Add flags for the daemon command.
+func daemon_flags(flags *flag.FlagSet) {
+	build_flags(flags)
+	flags.BoolVar(&watch, "watch", true, "Start a run when package sources change")
+	flags.DurationVar(&poll_interval, "poll", 15 * time.Minute, "Interval to start a run at, to pick up changes to the repository (0 to disable)")
+	flags.DurationVar(&debounce_delay, "debounce", 10 * time.Second, "How long to wait for further changes before starting a run")
+	flags.StringVar(&listen, "listen", "", "Address to serve the status page and API on (e.g. localhost:8080)")
+	flags.StringVar(&webhook_secret, "webhook-secret", "", "File containing the secret of GitHub, Gitea, and generic webhooks")
+	flags.StringVar(&webhook_sourcehut_key, "webhook-sourcehut-key", "", "Public key (base64) of the sourcehut instance sending webhooks")
+	flags.StringVar(&webhook_ref, "webhook-ref", "", "Branch that webhooks must push to (default: the branch checked out in the package sources)")
+	flags.StringVar(&api_token, "api-token", "", "File containing the token required to start runs through the API (default: the webhook secret)")
+}
+
+// Add flags for the verify command.
+func verify_flags(flags *flag.FlagSet) {
+	plan_flags(flags)
+	flags.StringVar(&destination, "destination", "./pkg", "Directory of packages")
+	flags.StringVar(&architecture, "architecture", "detected from repository", "architecture to build")
+	flags.BoolVar(&remote, "remote", false, "Audit the repository instead of built packages")
+	flags.BoolVar(&checksums, "checksums", false, "Fetch every package to compare checksums when auditing the repository")
+}
+
+// Add flags for the checksum command.
+func checksum_flags(flags *flag.FlagSet) {
+	source_flags(flags)
+	flags.StringVar(&distfiles, "distfiles", "./distfiles", "Directory to cache sources in")
+}
+
+// Add flags for the lint command.
+func lint_flags(flags *flag.FlagSet) {
+	source_flags(flags)
+	flags.StringVar(&repository, "repository", "", "Connection string for the remote package repository, to check dependencies against")
+	flags.BoolVar(&json_output, "json", false, "Print problems as JSON")
+}
+
+// Add flags for the prune command.
+func prune_flags(flags *flag.FlagSet) {
+	repository_flags(flags)
+	flags.IntVar(&keep, "keep", 1, "Number of versions of each package to keep")
+	flags.StringVar(&newer_than, "newer-than", "", "Also keep versions modified after a date (YYYY-MM-DD)")
+	flags.StringVar(&signing_key, "signing-key", "", "Private key to sign the index with (required unless -dry-run)")
+	flags.BoolVar(&dry_run, "dry-run", false, "List packages that would be removed")
+	flags.StringVar(&architecture, "architecture", "detected from repository", "architecture of the repository")
+	flags.StringVar(&state_dir, "state", "./state", "Directory of build state files")
+}
+
+// Add flags for the clean command.
+func clean_flags(flags *flag.FlagSet) {
+	repository_flags(flags)
+	flags.StringVar(&destination, "destination", "./pkg", "Directory of packages")
+	flags.StringVar(&architecture, "architecture", "detected from repository", "architecture to build")
+}
+
+// Add flags for the reproduce command.
+func reproduce_flags(flags *flag.FlagSet) {
+	source_flags(flags)
+	flags.StringVar(&repository, "repository", "", "Connection string for the remote package repository")
+	flags.StringVar(&sections, "section-repository", "", "Comma-separated SECTION=CONNECTION mappings of sections to remote package repositories")
+	flags.StringVar(&only, "only", "", "Comma-separated glob patterns of packages to check")
+	flags.StringVar(&exclude, "exclude", "", "Comma-separated glob patterns of packages to skip")
+	flags.StringVar(&state_dir, "state", "./state", "Directory of build state files")
+	flags.StringVar(&architecture, "architecture", "detected from repository", "architecture to build")
+	flags.StringVar(&sync_mode, "sync", "all", "Pull packages (all), only the index (index), or nothing (none) from the repository before each build")
+	flags.BoolVar(&local_repository, "local-repository", true, "Use the pulled repository as a repository inside build containers")
+	flags.StringVar(&container_repositories, "container-repository", "", "Comma-separated URLs of additional repositories to use inside build containers")
+	flags.StringVar(&public_key, "public-key", "", "Public key to install inside build containers")
+	flags.StringVar(&distfiles, "distfiles", "", "Directory to fetch and verify sources into before building (by default, build containers fetch sources)")
+	flags.StringVar(&image_name, "image", builder_image, "Image to create build containers from")
+	flags.StringVar(&pull_policy, "pull", pull_if_missing, "Pull the image before every build (always), only if it is not present (if-missing), or never (never)")
+	flags.StringVar(&pin_image, "pin-image", "", "Comma-separated [CONNECTION=]DIGEST pins of the image for each repository (or all)")
+	flags.BoolVar(&cross, "cross", false, "Cross-compile with abuild (CBUILD and CHOST) instead of emulating a foreign architecture (experimental)")
+	flags.BoolVar(&reproduce_twice, "twice", false, "Build twice even if the repository has the same version")
+	flags.StringVar(&source_date_epoch, "source-date-epoch", "", "Timestamp to build with (default: the build date in the repository, or the last commit to the package source)")
+}
+
+// Add flags for the history command.
+func history_flags(flags *flag.FlagSet) {
+	common_flags(flags)
+	flags.StringVar(&state_dir, "state", "./state", "Directory of build state files")
+	flags.StringVar(&repository, "repository", "", "Only show runs for a repository (connection string)")
+	flags.StringVar(&architecture, "architecture", "detected from repository", "architecture of the repository")
+	flags.StringVar(&history_package, "package", "", "Only show builds of a package")
+	flags.BoolVar(&history_failures, "failures", false, "Only show failures")
+	flags.IntVar(&history_last, "last", 10, "Number of runs to show (0 for all)")
+}
+
+// Add flags for calling the program without a command. These are the flags
+// from before commands were introduced.
+func compatibility_flags(flags *flag.FlagSet) {
+	build_flags(flags)
+	flags.BoolVar(&build, "build", false, "Build packages (same as the build command)")
+	flags.BoolVar(&summary, "summary", false, "Summarize packages to build (same as the plan command), also before building with -build")
+}
+
+// Find a Command by name.
+func find_command(name string) int {
+	for i, cmd := range commands {
+		if (cmd.Name == name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Print usage information for the program.
+func usage(flags *flag.FlagSet) func() {
+	return func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: simple-builder COMMAND [options]\n\n")
+		fmt.Fprintf(out, "Commands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(out, "  %-12s %s\n", cmd.Name, cmd.Description)
+		}
+		fmt.Fprintf(out, "\nTry `simple-builder COMMAND -help` for the options of a command.\n")
+		fmt.Fprintf(out, "Without a command, these options are accepted:\n")
+		flags.PrintDefaults()
+	}
+}
+
+// Print usage information for a Command.
+func command_usage(flags *flag.FlagSet, cmd Command) func() {
+	return func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: simple-builder %s [options] %s\n\n", cmd.Name, cmd.Arguments)
+		fmt.Fprintf(out, "%s.\n\nOptions:\n", cmd.Description)
+		flags.PrintDefaults()
+	}
+}
+
+// Parse the command line and run a Command. If the first argument is not a
+// command, the arguments are parsed as they were before commands were
+// introduced, and either the plan or build command is run.
+func dispatch(args []string) error {
+	if (0 < len(args)) && (args[0] == "help") {
+		if (1 < len(args)) && (find_command(args[1]) != -1) {
+			args = []string{args[1], "-help"}
+		} else {
+			args = []string{"-help"}
+		}
+	}
+
+	if (0 < len(args)) {
+		i := find_command(args[0])
+		if (i != -1) {
+			cmd := commands[i]
+			flags := flag.NewFlagSet(cmd.Name, flag.ExitOnError)
+			flags.Usage = command_usage(flags, cmd)
+			cmd.Flags(flags)
+			flags.Parse(args[1:])
+
+			err := configure_logging(log_level, log_format, verbose)
+			if (err != nil) {
+				return err
+			}
+			return cmd.Run(flags.Args())
+		}
+	}
+
+	flags := flag.NewFlagSet("simple-builder", flag.ExitOnError)
+	flags.Usage = usage(flags)
+	compatibility_flags(flags)
+	flags.Parse(args)
+
+	err := configure_logging(log_level, log_format, verbose)
+	if (err != nil) {
+		return err
+	}
+
+	if (build == true) {
+		return run_build(flags.Args())
+	}
+	return run_plan(flags.Args())
+}
+
+// Clean up -only PATTERNS and -exclude PATTERNS along with the positional
+// package arguments.
+func clean_selection(args []string) Selection {
+	return new_selection(
+		append(clean_patterns(only), args...),
+		clean_patterns(exclude),
+		with_deps,
+		with_rdeps,
+		force,
+	)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Summarize packages to build. This is the `plan` command.
+func run_plan(args []string) error {
+	src := clean_source(source)
+	repo := clean_repository(repository)
+
+	packages, err := compare_lists(src, depth, repo, clean_sections(sections), clean_selection(args))
+	if (err != nil) {
+		return err
+	}
+
+	summarize_packages(packages)
+	return nil
+}
+
+// Build packages and push them. This is the `build` command.
+func run_build(args []string) error {
+	src := clean_source(source)
+	pkg := clean_destination(destination)
+	repo := clean_repository(repository)
+	arch := clean_architecture(architecture, repo)
+	state := clean_state(state_dir)
+	sync_mode = clean_sync(sync_mode)
+	opts := clean_build_options(local_repository, container_repositories, public_key, distfiles, clean_image_options(image_name, pull_policy, pin_image, arch), cross)
+	notify := clean_notify_options(notify_email, smtp_server, smtp_from, notify_webhook, notify_exec, notify_on)
+
+	packages, err := compare_lists(src, depth, repo, clean_sections(sections), clean_selection(args))
+	if (err != nil) && (dry_run == false) {
+		return finish_run(new_run(target_name(repo, arch)), err, state, notify)
+	} else if (err != nil) {
+		return err
+	}
+
+	// Only set by -summary, when called without a command.
+	if (summary == true) {
+		summarize_run(packages)
+	}
+
+	return build_packages(packages, pkg, arch, state, opts, notify, resume)
+}
+
+// Push packages that were built but not pushed. This is the `push` command.
+func run_push(args []string) error {
+	src := clean_source(source)
+	pkg := clean_destination(destination)
+	repo := clean_repository(repository)
+	arch := clean_architecture(architecture, repo)
+	state := clean_state(state_dir)
+
+	packages, err := compare_lists(src, depth, repo, clean_sections(sections), clean_selection(args))
+	if (err != nil) {
+		return err
+	}
+
+	return push_packages(packages, pkg, arch, state)
+}
+
+// List package sources. This is the `list-local` command.
+func run_list_local(args []string) error {
+	packages, err := list_package_sources(clean_source(source), depth)
+	if (err != nil) {
+		return err
+	}
+
+	for _, p := range packages {
+		if (len(p.Dependencies) == 0) {
+			fmt.Printf("%s %s\n", p.Name, p.Version)
+		} else {
+			fmt.Printf("%s %s (depends on %s)\n", p.Name, p.Version, strings.Join(p.Dependencies, ", "))
+		}
+	}
+
+	return nil
+}
+
+// List packages in the repository. This is the `list-remote` command.
+func run_list_remote(args []string) error {
+	packages, err := list_repository(clean_repository(repository))
+	if (err != nil) {
+		return err
+	}
+
+	for _, p := range packages {
+		fmt.Printf("%s %s\n", p.Name, p.Version)
+	}
+
+	return nil
+}
+
+// Print the dependency graph of package sources in DOT format. Dependencies
+// that are not package sources are drawn dashed. This is the `graph` command.
+func run_graph(args []string) error {
+	packages, err := list_package_sources(clean_source(source), depth)
+	if (err != nil) {
+		return err
+	}
+
+	external := []string{}
+
+	fmt.Println("digraph packages {")
+	for _, p := range packages {
+		fmt.Printf("\t%q [label=%q];\n", p.Name, p.Name + "\n" + p.Version)
+		for _, d := range p.Dependencies {
+			fmt.Printf("\t%q -> %q;\n", p.Name, d)
+			if (find_package(&packages, d) == -1) && (find_string(&external, d) == -1) {
+				external = append(external, d)
+			}
+		}
+	}
+	for _, d := range external {
+		fmt.Printf("\t%q [style=dashed];\n", d)
+	}
+	fmt.Println("}")
+
+	return nil
+}
+
+// Verify that packages to push were built and match their package sources,
+// or audit the repository. This is the `verify` command.
+func run_verify(args []string) error {
+	if (remote == true) {
+		return run_audit()
+	}
+
+	src := clean_source(source)
+	pkg := clean_destination(destination)
+	repo := clean_repository(repository)
+	arch := clean_architecture(architecture, repo)
+
+	packages, err := compare_lists(src, depth, repo, clean_sections(sections), clean_selection(args))
+	if (err != nil) {
+		return err
+	}
+
+	failed := 0
+	for _, p := range packages {
+		local_dir := expected_apkdir(package_destination(pkg, p), arch)
+		problems := check_artifact(p, arch, path.Join(local_dir, expected_apk(p)))
+		if (len(problems) == 0) {
+			fmt.Printf("%s %s - ok\n", p.Name, p.Version)
+		} else {
+			fmt.Printf("%s %s - %s\n", p.Name, p.Version, strings.Join(problems, "; "))
+			failed++
+		}
+	}
+
+	if (failed != 0) {
+		return fmt.Errorf("%d packages failed verification", failed)
+	}
+	return nil
+}
+
+// Audit the repository. This is the `verify -remote` command.
+func run_audit() error {
+	problems, warnings, err := audit_repository(clean_repository(repository), checksums)
+	if (err != nil) {
+		return err
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if (len(warnings) != 0) {
+		fmt.Println("Warnings:")
+		for _, warning := range warnings {
+			fmt.Println(warning)
+		}
+	}
+
+	if (len(problems) != 0) {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Println("No problems found")
+	return nil
+}
+
+// Remove superseded packages from the repository. This is the `prune`
+// command.
+func run_prune(args []string) error {
+	repo := clean_repository(repository)
+	if (keep < 1) {
+		return errors.New("Must keep at least 1 version")
+	}
+
+	// apk rejects a repository with an unsigned index.
+	if (signing_key == "") && (dry_run == false) {
+		return errors.New("Pruning rewrites the index, so -signing-key is required (or use -dry-run)")
+	}
+
+	key := clean_signing_key(signing_key)
+	if (dry_run == true) {
+		return prune_repository(repo, keep, clean_date(newer_than), key, dry_run)
+	}
+
+	// A run that pushes while the index is rewritten would be lost, so the
+	// target is locked from the listing until the apks are deleted.
+	lock := lock_filename(clean_state(state_dir), target_name(repo, clean_architecture(architecture, repo)))
+	err := acquire_lock(lock)
+	if (err != nil) {
+		return err
+	}
+	defer release_lock(lock)
+
+	return prune_repository(repo, keep, clean_date(newer_than), key, dry_run)
+}
+
+// Remove built packages from the destination. This is the `clean` command.
+func run_clean(args []string) error {
+	pkg := clean_destination(destination)
+	arch := clean_architecture(architecture, clean_repository(repository))
+	local_dir := expected_apkdir(pkg, arch)
+
+	filenames, err := filepath.Glob(path.Join(local_dir, "*.apk"))
+	if (err != nil) {
+		return err
+	}
+	filenames = append(filenames, path.Join(local_dir, "APKINDEX.tar.gz"))
+
+	// Sections that are mapped to a different repository are built into
+	// subdirectories.
+	section_filenames, err := filepath.Glob(path.Join(pkg, "*", path.Base(local_dir), "*.apk"))
+	if (err != nil) {
+		return err
+	}
+	filenames = append(filenames, section_filenames...)
+	section_filenames, err = filepath.Glob(path.Join(pkg, "*", path.Base(local_dir), "APKINDEX.tar.gz"))
+	if (err != nil) {
+		return err
+	}
+	filenames = append(filenames, section_filenames...)
+
+	for _, filename := range filenames {
+		err = os.Remove(filename)
+		if (errors.Is(err, os.ErrNotExist) == true) {
+			continue
+		} else if (err != nil) {
+			return err
+		}
+		logger("clean").Debug("Removed", "file", filename)
+	}
+
+	return nil
+}
+
+// Update sha512sums of package sources. This is the `checksum` command.
+func run_checksum(args []string) error {
+	if (len(args) == 0) {
+		return errors.New("No packages given")
+	}
+
+	packages, err := list_package_sources(clean_source(source), depth)
+	if (err != nil) {
+		return err
+	}
+
+	distdir := clean_distfiles(distfiles)
+
+	for _, name := range args {
+		i := find_package(&packages, name)
+		if (i == -1) {
+			return fmt.Errorf("No package source for %s", name)
+		}
+
+		lines, err := compute_checksums(packages[i], distdir)
+		if (err != nil) {
+			return err
+		}
+
+		err = write_checksums(packages[i], lines)
+		if (err != nil) {
+			return err
+		}
+		fmt.Printf("Updated sha512sums of %s\n", name)
+	}
+
+	return nil
+}
+
+// Check package sources for problems. This is the `lint` command.
+func run_lint(args []string) error {
+	packages, source_errors, err := scan_package_sources(clean_source(source), depth)
+	if (err != nil) {
+		return err
+	}
+
+	var remote []Package
+	if (repository != "") {
+		remote, err = list_repository(clean_repository(repository))
+		if (err != nil) {
+			return err
+		}
+	}
+
+	problems := lint_package_sources(packages, source_errors, remote)
+
+	if (json_output == true) {
+		err = print_lint_problems_json(problems)
+		if (err != nil) {
+			return err
+		}
+	} else {
+		print_lint_problems(problems)
+	}
+
+	if (len(problems) != 0) {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Options for the daemon command.
+var (
+	watch bool
+	poll_interval time.Duration
+	debounce_delay time.Duration
+	listen string
+	webhook_secret string
+	webhook_sourcehut_key string
+	webhook_ref string
+	api_token string
+)
+
+// Trigger stores the reason to start a run. If Packages are given, only those
+// are built, and if Paths are given, only the package sources containing them
+// are built. Forced Triggers rebuild the Packages even if the repository is up
+// to date. Package sources are pulled from their git remote first if
+// requested.
+type Trigger struct {
+	Reason   string
+	Packages []string
+	Paths    []string
+	Force    bool
+	Pull     bool
+}
+
+// Check if a Trigger is for a run of every package source.
+func (trigger Trigger) is_full() bool {
+	return (len(trigger.Packages) == 0) && (len(trigger.Paths) == 0)
+}
+
+// Send a Trigger without blocking. If the channel is full, runs are already
+// pending and the Trigger is dropped.
+func send_trigger(triggers chan<- Trigger, trigger Trigger) bool {
+	select {
+	case triggers <- trigger:
+		return true
+	default:
+		logger("daemon").Warn("Dropping trigger, runs are pending", "reason", trigger.Reason)
+		return false
+	}
+}
+
+// Send a Trigger at an interval.
+func poll_repository(interval time.Duration, triggers chan<- Trigger) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		send_trigger(triggers, Trigger{Reason: "poll"})
+	}
+}
+
+// Given a Trigger, wait until no other Trigger has arrived for the debounce
+// delay. Returns the merged Triggers.
+func debounce_triggers(triggers <-chan Trigger, first Trigger, delay time.Duration) []Trigger {
+	pending := []Trigger{first}
+
+	for {
+		select {
+		case trigger := <-triggers:
+			pending = append(pending, trigger)
+		case <-time.After(delay):
+			return merge_triggers(pending)
+		}
+	}
+}
+
+// Merge Triggers into as few runs as possible. A full run covers every other
+// Trigger, except for forced rebuilds.
+func merge_triggers(pending []Trigger) []Trigger {
+	full := Trigger{}
+	selected := Trigger{}
+	forced := Trigger{Force: true}
+	pull := false
+
+	for _, trigger := range pending {
+		merged := &selected
+		if (trigger.is_full() == true) {
+			merged = &full
+		} else if (trigger.Force == true) {
+			merged = &forced
+		}
+
+		if (strings.Contains(", " + (*merged).Reason + ", ", ", " + trigger.Reason + ", ") == false) {
+			if ((*merged).Reason != "") {
+				(*merged).Reason += ", "
+			}
+			(*merged).Reason += trigger.Reason
+		}
+		for _, name := range trigger.Packages {
+			if (find_string(&(*merged).Packages, name) == -1) {
+				(*merged).Packages = append((*merged).Packages, name)
+			}
+		}
+		(*merged).Paths = append((*merged).Paths, trigger.Paths...)
+		pull = pull || trigger.Pull
+	}
+
+	runs := []Trigger{}
+	if (full.Reason != "") {
+		runs = append(runs, full)
+	} else if (selected.Reason != "") {
+		runs = append(runs, selected)
+	}
+	if (forced.Reason != "") {
+		runs = append(runs, forced)
+	}
+
+	// Pull before the first run.
+	if (len(runs) != 0) {
+		runs[0].Pull = pull
+	}
+	return runs
+}
+
+// Find the package sources that contain any of a list of paths. Paths are
+// relative to the top level of the git repository of a package source
+// directory, or else to the directory itself.
+func find_packages_by_paths(roots []string, depth int, paths []string) ([]string, error) {
+	package_sources, err := list_package_sources(roots, depth)
+	if (err != nil) {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, root := range roots {
+		toplevel, err := git_toplevel(root)
+		if (err != nil) {
+			toplevel = root
+		}
+
+		for _, changed := range paths {
+			filename := path.Join(toplevel, changed)
+			for _, pkg := range package_sources {
+				if (strings.HasPrefix(filename, pkg.Path + "/") == true) && (find_string(&names, pkg.Name) == -1) {
+					names = append(names, pkg.Name)
+				}
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// Plan and build packages whenever package sources change or the repository
+// is polled. Runs never overlap, and a failed run does not stop the daemon.
+// This is the `daemon` command.
+func run_daemon(args []string) error {
+	src := clean_source(source)
+	pkg := clean_destination(destination)
+	repo := clean_repository(repository)
+	arch := clean_architecture(architecture, repo)
+	state := clean_state(state_dir)
+	sync_mode = clean_sync(sync_mode)
+	opts := clean_build_options(local_repository, container_repositories, public_key, distfiles, clean_image_options(image_name, pull_policy, pin_image, arch), cross)
+	notify := clean_notify_options(notify_email, smtp_server, smtp_from, notify_webhook, notify_exec, notify_on)
+	section_map := clean_sections(sections)
+	sel := clean_selection(args)
+	webhook := clean_webhook_options(webhook_secret, webhook_sourcehut_key, webhook_ref)
+	token := clean_api_token(api_token, webhook)
+
+	if (webhook.is_enabled() == true) && (listen == "") {
+		return errors.New("Webhooks require -listen")
+	}
+	// Pushes to other branches are not pulled, so they are ignored.
+	if (webhook.is_enabled() == true) && (webhook.Ref == "") {
+		ref, err := git_branch(src[0])
+		if (err != nil) {
+			return fmt.Errorf("Cannot find the branch of the package sources (use -webhook-ref): %s", err)
+		}
+		webhook.Ref = ref
+	}
+	if (api_token != "") && (listen == "") {
+		return errors.New("An API token requires -listen")
+	}
+	// Rewriting APKBUILDs would be picked up as a change, and start the
+	// next run.
+	if (bump_pkgrel == true) {
+		return errors.New("The daemon does not accept -bump-pkgrel, since rewriting APKBUILDs would start another run")
+	}
+	if (watch == false) && (poll_interval <= 0) && (listen == "") {
+		return errors.New("Nothing would trigger a run (use -watch, -poll, or -listen)")
+	}
+
+	triggers := make(chan Trigger, 16)
+	failures := make(chan error, 1)
+
+	if (watch == true) {
+		go func() {
+			failures <- watch_sources(src, triggers)
+		}()
+	}
+	if (poll_interval > 0) {
+		go poll_repository(poll_interval, triggers)
+	}
+	if (listen != "") {
+		restore_metrics(state)
+		go func() {
+			failures <- serve_status(listen, state, triggers, webhook, token)
+		}()
+	}
+
+	run := func(trigger Trigger) {
+		logger("daemon").Info("Starting run", "reason", trigger.Reason)
+		builder_status.planning(trigger.Reason)
+
+		packages, err := plan_trigger(trigger, src, repo, section_map, sel)
+		if (err == nil) {
+			builder_status.planned(packages)
+			summarize_run(packages)
+			err = build_packages(packages, pkg, arch, state, opts, notify, resume)
+		} else {
+			err = finish_run(new_run(target_name(repo, arch)), err, state, notify)
+		}
+
+		builder_status.finished(err)
+		if (err != nil) {
+			logger("daemon").Error("Run failed", "reason", trigger.Reason, "error", err)
+		}
+	}
+
+	// Catch up on anything that changed while the daemon was not running.
+	send_trigger(triggers, Trigger{Reason: "startup"})
+
+	for {
+		select {
+		case err := <-failures:
+			return err
+		case trigger := <-triggers:
+			for _, merged := range debounce_triggers(triggers, trigger, debounce_delay) {
+				run(merged)
+			}
+		}
+	}
+}
+
+// Plan a run for a Trigger. Unless the Trigger is for a full run, the
+// Selection is replaced by the Packages of the Trigger.
+func plan_trigger(trigger Trigger, src []string, repo string, section_map map[string]string, sel Selection) ([]Package, error) {
+	if (trigger.Pull == true) {
+		err := pull_package_sources(src)
+		if (err != nil) {
+			return nil, err
+		}
+	}
+
+	if (trigger.is_full() == true) {
+		return compare_lists(src, depth, repo, section_map, sel)
+	}
+
+	names := trigger.Packages
+	if (len(trigger.Paths) != 0) {
+		found, err := find_packages_by_paths(src, depth, trigger.Paths)
+		if (err != nil) {
+			return nil, err
+		}
+		names = append(names, found...)
+	}
+	if (len(names) == 0) {
+		return []Package{}, nil
+	}
+
+	return compare_lists(src, depth, repo, section_map, new_selection(names, sel.Exclude, sel.WithDeps, sel.WithRdeps, trigger.Force))
+}
+
+// Print details about Packages queued for build by the daemon.
+func summarize_run(packages []Package) {
+	if (len(packages) == 0) {
+		fmt.Println("Nothing to do")
+		return
+	}
+
+	fmt.Println("Packages to build:")
+	for _, p := range packages {
+		fmt.Printf("  %s %s - %s\n", p.Name, p.Version, p.Message)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeTriggers(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending []Trigger
+		want    []Trigger
+	}{
+		{
+			"empty",
+			[]Trigger{},
+			[]Trigger{},
+		},
+		{
+			"nil",
+			nil,
+			[]Trigger{},
+		},
+		{
+			"selected",
+			[]Trigger{
+				{Reason: "watch", Paths: []string{"src/foo/APKBUILD"}},
+				{Reason: "github webhook", Paths: []string{"src/bar/APKBUILD"}, Pull: true},
+				{Reason: "watch", Paths: []string{"src/foo/foo.patch"}},
+			},
+			[]Trigger{
+				{Reason: "watch, github webhook", Paths: []string{"src/foo/APKBUILD", "src/bar/APKBUILD", "src/foo/foo.patch"}, Pull: true},
+			},
+		},
+		{
+			"full covers selected",
+			[]Trigger{
+				{Reason: "watch", Paths: []string{"src/foo/APKBUILD"}},
+				{Reason: "poll"},
+			},
+			[]Trigger{
+				{Reason: "poll"},
+			},
+		},
+		{
+			"forced after full",
+			[]Trigger{
+				{Reason: "api", Packages: []string{"foo"}, Force: true},
+				{Reason: "poll"},
+				{Reason: "api", Packages: []string{"bar", "foo"}, Force: true, Pull: true},
+			},
+			[]Trigger{
+				{Reason: "poll", Pull: true},
+				{Reason: "api", Packages: []string{"foo", "bar"}, Force: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := merge_triggers(test.pending)
+		if (reflect.DeepEqual(got, test.want) == false) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
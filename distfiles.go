@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Distfiles are mounted here, which is the default SRCDEST of abuild.
+const container_distfiles = "/var/cache/distfiles"
+
+// Sources are fetched with this client, so that a stalled mirror fails the
+// fetch instead of hanging the run.
+var distfiles_client = &http.Client{
+	Timeout: 30 * time.Minute,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout: 30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+// Source stores an entry of `source=` from an APKBUILD. Remote sources have a
+// URL. Local sources are files in the package source directory.
+type Source struct {
+	Name string
+	URL  string
+}
+
+// Parse the `source=` entries of a Package. Remote sources are named like
+// `name::url`, or else after the last element of the URL.
+func parse_sources(pkg Package) []Source {
+	sources := []Source{}
+
+	for _, entry := range pkg.Sources {
+		name, location, renamed := strings.Cut(entry, "::")
+		if (renamed == false) {
+			location = entry
+			name = path.Base(entry)
+		}
+
+		if (strings.Contains(location, "://") == true) {
+			sources = append(sources, Source{name, location})
+		} else {
+			sources = append(sources, Source{name, ""})
+		}
+	}
+
+	return sources
+}
+
+// Fetch the remote sources of a Package into the distfiles cache, and verify
+// the checksums of all sources. Distfiles that are already cached and match
+// their checksums are not fetched again.
+func fetch_distfiles(pkg Package, cache_dir string) error {
+	err := os.MkdirAll(cache_dir, 0755)
+	if (err != nil) {
+		return err
+	}
+
+	for _, src := range parse_sources(pkg) {
+		checksum, ok := pkg.Checksums[src.Name]
+		if (ok == false) {
+			return fmt.Errorf("No sha512sums entry for %s in %s", src.Name, pkg.Name)
+		}
+
+		if (src.URL == "") {
+			err = verify_checksum(path.Join(pkg.Path, src.Name), checksum)
+			if (err != nil) {
+				return err
+			}
+			continue
+		}
+
+		filename := path.Join(cache_dir, src.Name)
+		if (verify_checksum(filename, checksum) == nil) {
+			logger("distfiles").Debug("Cached", "file", src.Name)
+			continue
+		}
+
+		logger("distfiles").Info("Fetching", "url", src.URL)
+		err = fetch_url(src.URL, filename + ".part")
+		if (err != nil) {
+			return err
+		}
+
+		err = verify_checksum(filename + ".part", checksum)
+		if (err != nil) {
+			os.Remove(filename + ".part")
+			return fmt.Errorf("Checksum mismatch for %s from %s", src.Name, src.URL)
+		}
+
+		err = os.Rename(filename + ".part", filename)
+		if (err != nil) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compute the checksums of the sources of a Package, in the format of
+// `sha512sums=`. Remote sources are always fetched again, since a cached file
+// might be stale, and replace the file in the distfiles cache.
+func compute_checksums(pkg Package, cache_dir string) ([]string, error) {
+	lines := []string{}
+
+	err := os.MkdirAll(cache_dir, 0755)
+	if (err != nil) {
+		return nil, err
+	}
+
+	for _, src := range parse_sources(pkg) {
+		filename := path.Join(pkg.Path, src.Name)
+
+		if (src.URL != "") {
+			filename = path.Join(cache_dir, src.Name)
+
+			logger("distfiles").Info("Fetching", "url", src.URL)
+			err = fetch_url(src.URL, filename + ".part")
+			if (err != nil) {
+				os.Remove(filename + ".part")
+				return nil, err
+			}
+
+			err = os.Rename(filename + ".part", filename)
+			if (err != nil) {
+				return nil, err
+			}
+		}
+
+		checksum, err := sha512_file(filename)
+		if (err != nil) {
+			return nil, err
+		}
+		lines = append(lines, checksum + "  " + src.Name)
+	}
+
+	return lines, nil
+}
+
+// Download a URL into a file. Supports `http://`, `https://`, and `file://`.
+func fetch_url(location, filename string) error {
+	u, err := url.Parse(location)
+	if (err != nil) {
+		return err
+	}
+
+	var body io.ReadCloser
+	if (u.Scheme == "file") {
+		body, err = os.Open(u.Path)
+		if (err != nil) {
+			return err
+		}
+	} else if (u.Scheme == "http") || (u.Scheme == "https") {
+		resp, err := distfiles_client.Get(location)
+		if (err != nil) {
+			return err
+		}
+		if (resp.StatusCode != http.StatusOK) {
+			resp.Body.Close()
+			return fmt.Errorf("Cannot fetch %s: %s", location, resp.Status)
+		}
+		body = resp.Body
+	} else {
+		return fmt.Errorf("Cannot fetch %s: unsupported scheme", location)
+	}
+	defer body.Close()
+
+	file, err := os.Create(filename)
+	if (err != nil) {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, body)
+	return err
+}
+
+// Compute the SHA512 checksum of a file, as used in `sha512sums=`.
+func sha512_file(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if (err != nil) {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha512.New()
+	_, err = io.Copy(hash, file)
+	if (err != nil) {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Verify the SHA512 checksum of a file.
+func verify_checksum(filename, checksum string) error {
+	actual, err := sha512_file(filename)
+	if (err != nil) {
+		return err
+	}
+
+	if (actual != checksum) {
+		return errors.New("Checksum mismatch for " + path.Base(filename))
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func sha512_string(content string) string {
+	sum := sha512.Sum512([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Serve a tarball and count how often it is fetched.
+func serve_distfile(t *testing.T, content string) (*httptest.Server, *int) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.URL.Path != "/foo-1.0.tar.gz") {
+			http.NotFound(w, r)
+			return
+		}
+		fetches++
+		w.Write([]byte(content))
+	}))
+	t.Cleanup(server.Close)
+	return server, &fetches
+}
+
+func TestFetchDistfiles(t *testing.T) {
+	server, fetches := serve_distfile(t, "tarball")
+	cache_dir := t.TempDir()
+
+	pkg := Package{
+		Name: "foo",
+		Path: t.TempDir(),
+		Sources: []string{server.URL + "/foo-1.0.tar.gz"},
+		Checksums: map[string]string{"foo-1.0.tar.gz": sha512_string("tarball")},
+	}
+
+	err := fetch_distfiles(pkg, cache_dir)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path.Join(cache_dir, "foo-1.0.tar.gz"))
+	if (err != nil) {
+		t.Fatal(err)
+	} else if (string(content) != "tarball") {
+		t.Errorf("got %q, want %q", content, "tarball")
+	}
+
+	// A cached distfile that matches its checksum is not fetched again.
+	err = fetch_distfiles(pkg, cache_dir)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	if (*fetches != 1) {
+		t.Errorf("fetched %d times, want 1", *fetches)
+	}
+}
+
+func TestFetchDistfilesMismatch(t *testing.T) {
+	server, _ := serve_distfile(t, "tampered")
+	cache_dir := t.TempDir()
+
+	pkg := Package{
+		Name: "foo",
+		Path: t.TempDir(),
+		Sources: []string{"foo-1.0.tar.gz::" + server.URL + "/foo-1.0.tar.gz"},
+		Checksums: map[string]string{"foo-1.0.tar.gz": sha512_string("tarball")},
+	}
+
+	err := fetch_distfiles(pkg, cache_dir)
+	if (err == nil) {
+		t.Fatal("expected a checksum mismatch")
+	}
+
+	// Neither the file nor the partial download are left in the cache.
+	entries, err := os.ReadDir(cache_dir)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("left %s in the cache", entry.Name())
+	}
+}
+
+func TestFetchDistfilesLocal(t *testing.T) {
+	pkg := Package{
+		Name: "foo",
+		Path: t.TempDir(),
+		Sources: []string{"local.patch"},
+		Checksums: map[string]string{"local.patch": sha512_string("patch")},
+	}
+
+	err := os.WriteFile(path.Join(pkg.Path, "local.patch"), []byte("patch"), 0644)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	err = fetch_distfiles(pkg, t.TempDir())
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	pkg.Checksums["local.patch"] = sha512_string("other")
+	err = fetch_distfiles(pkg, t.TempDir())
+	if (err == nil) {
+		t.Errorf("expected a checksum mismatch for a local source")
+	}
+}
+
+func TestFetchDistfilesNotFound(t *testing.T) {
+	server, _ := serve_distfile(t, "tarball")
+
+	pkg := Package{
+		Name: "foo",
+		Path: t.TempDir(),
+		Sources: []string{server.URL + "/missing.tar.gz"},
+		Checksums: map[string]string{"missing.tar.gz": sha512_string("tarball")},
+	}
+
+	err := fetch_distfiles(pkg, t.TempDir())
+	if (err == nil) {
+		t.Errorf("expected an error for a missing distfile")
+	}
+}
+
+func TestComputeChecksumsStaleCache(t *testing.T) {
+	server, fetches := serve_distfile(t, "tarball")
+	cache_dir := t.TempDir()
+
+	// A stale distfile from an earlier release of the same name.
+	err := os.WriteFile(path.Join(cache_dir, "foo-1.0.tar.gz"), []byte("stale"), 0644)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	pkg := Package{
+		Name: "foo",
+		Path: t.TempDir(),
+		Sources: []string{server.URL + "/foo-1.0.tar.gz"},
+	}
+
+	lines, err := compute_checksums(pkg, cache_dir)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	want := sha512_string("tarball") + "  foo-1.0.tar.gz"
+	if (len(lines) != 1) || (lines[0] != want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+	if (*fetches != 1) {
+		t.Errorf("fetched %d times, want 1", *fetches)
+	}
+}
@@ -1,67 +1,150 @@
 package main
 
 import (
-	"bufio"
+	"archive/tar"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-// Create a container for building a package, start the build, and branch
-// based on the result.
-func build_package(pkg Package, srcdir, pkgdir, arch string) error {
-	ctx := context.Background()
+// The destination is mounted here. apk can use it as a repository.
+const container_repository = "/home/builder/packages/src"
 
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if (err != nil) {
-		return err
-	}
+// BuildOptions stores the configuration of build containers beyond the
+// package sources, destination, and architecture.
+type BuildOptions struct {
+	Repositories []string
+	PublicKey    string
+	Distfiles    string
+	Environment  []string
+	Image        ImageOptions
+	Cross        bool
+	Host         string
+}
+
+// The image that build containers are created from by default.
+const builder_image = "registry.intra.dominic-ricottone.com/apkbuilder:latest"
+
+// Check if a package for an architecture is cross-compiled, rather than
+// built in a container of that architecture.
+func is_cross(arch string, opts BuildOptions) bool {
+	return (opts.Cross == true) && (opts.Host != "") && (opts.Host != arch)
+}
+
+// Construct the GNU host triplet that abuild cross-compiles for, like
+// `aarch64-alpine-linux-musl`.
+func cross_hostspec(arch string) string {
+	return apk_architecture(arch) + "-alpine-linux-musl"
+}
 
+// Construct the configuration of a container for building a package. When
+// cross-compiling, the container has the architecture of the Docker host, and
+// abuild is told the target architecture through CBUILD and CHOST.
+func container_config(pkg Package, pkgdir, arch string, opts BuildOptions) (container.Config, container.HostConfig, specs.Platform) {
 	conf := container.Config{
-		Image: "registry.intra.dominic-ricottone.com/apkbuilder:latest",
+		Image: image_reference(opts.Image, pkg.Repository, arch),
 		Cmd: []string{pkg.Name},
+		Env: append([]string{}, opts.Environment...),
 	}
 
 	con_conf := container.HostConfig{
 		Mounts: []mount.Mount{
 			{
 				Type: mount.TypeBind,
-				Source: srcdir,
+				Source: path.Dir(pkg.Path),
 				Target: "/home/builder/src",
 			},
 			{
 				Type: mount.TypeBind,
 				Source: pkgdir,
-				Target: "/home/builder/packages/src",
+				Target: container_repository,
 			},
 		},
 	}
 
+	if (opts.Distfiles != "") {
+		con_conf.Mounts = append(con_conf.Mounts, mount.Mount{
+			Type: mount.TypeBind,
+			Source: opts.Distfiles,
+			Target: container_distfiles,
+		})
+	}
+
 	plats := specs.Platform{
 		Architecture: arch,
 		OS: "linux",
 	}
 
+	if (is_cross(arch, opts) == true) {
+		plats.Architecture = opts.Host
+		conf.Env = append(conf.Env, "CBUILD=" + apk_architecture(opts.Host), "CHOST=" + apk_architecture(arch))
+	}
+
+	return conf, con_conf, plats
+}
+
+// Create a container for building a package, start the build, and branch
+// based on the result. The image is pulled first if the pull policy requires
+// it. The build log is saved, and the ID and registry digest of the image used
+// are returned.
+func build_package(pkg Package, pkgdir, arch string, opts BuildOptions, log_file string) (string, string, error) {
+	ctx := context.Background()
+
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if (err != nil) {
+		return "", "", err
+	}
+
+	conf, con_conf, plats := container_config(pkg, pkgdir, arch, opts)
+	ref := conf.Image
+
+	conf.Image, err = ensure_image(cli, ctx, ref, opts.Image.Pull, plats)
+	if (err != nil) {
+		return "", "", err
+	}
+
 	con, err := cli.ContainerCreate(ctx, &conf, &con_conf, nil, &plats, "")
 	if (err != nil) {
-		return err
+		return "", "", err
+	}
+
+	info, err := cli.ContainerInspect(ctx, con.ID)
+	if (err != nil) {
+		return "", "", err
+	}
+
+	digest, err := image_digest(cli, ctx, ref, info.Image)
+	if (err != nil) {
+		return info.Image, "", err
+	}
+	logger("docker").Info("Using image", "image", ref, "id", info.Image, "digest", digest)
+
+	err = configure_repositories(cli, ctx, con.ID, arch, opts)
+	if (err != nil) {
+		return info.Image, digest, err
 	}
 
 	start_opts := types.ContainerStartOptions{}
 
 	cli.ContainerStart(ctx, con.ID, start_opts)
 
-	err = check_result(cli, ctx, con.ID)
+	err = check_result(cli, ctx, con.ID, log_file)
 	if (err != nil) {
-		return err
+		return info.Image, digest, err
 	}
 
 	rm_opts := types.ContainerRemoveOptions{
@@ -70,14 +153,98 @@ func build_package(pkg Package, srcdir, pkgdir, arch string) error {
 
 	cli.ContainerRemove(ctx, con.ID, rm_opts)
 
-	return nil
+	return info.Image, digest, nil
+}
+
+// Add apk repositories to a container that has not been started yet, along
+// with the public key that packages in those repositories are signed with.
+func configure_repositories(cli *client.Client, ctx context.Context, id, arch string, opts BuildOptions) error {
+	repositories := []string{}
+	for _, repo := range opts.Repositories {
+		// The local repository has packages of the target architecture,
+		// which cannot be installed in a cross-compiling container.
+		if (repo == container_repository) && (is_cross(arch, opts) == true) {
+			logger("docker").Debug("Not adding the local repository when cross-compiling", "repository", repo)
+			continue
+		}
+		repositories = append(repositories, repo)
+	}
+	if (len(repositories) == 0) {
+		return nil
+	}
+
+	out, _, err := cli.CopyFromContainer(ctx, id, "/etc/apk/repositories")
+	if (err != nil) {
+		return err
+	}
+	defer out.Close()
+
+	archive := tar.NewReader(out)
+	_, err = archive.Next()
+	if (err != nil) {
+		return err
+	}
+	existing, err := io.ReadAll(archive)
+	if (err != nil) {
+		return err
+	}
+
+	lines := strings.TrimRight(string(existing), "\n") + "\n"
+	for _, repo := range repositories {
+		logger("docker").Debug("Adding repository", "repository", repo)
+		lines += repo + "\n"
+	}
+
+	err = copy_file_to_container(cli, ctx, id, "/etc/apk", "repositories", []byte(lines))
+	if (err != nil) {
+		return err
+	}
+
+	if (opts.PublicKey == "") {
+		return nil
+	}
+
+	key, err := os.ReadFile(opts.PublicKey)
+	if (err != nil) {
+		return err
+	}
+
+	logger("docker").Debug("Adding key", "key", opts.PublicKey)
+	return copy_file_to_container(cli, ctx, id, "/etc/apk/keys", path.Base(opts.PublicKey), key)
+}
+
+// Copy a file into a directory of a container.
+func copy_file_to_container(cli *client.Client, ctx context.Context, id, directory, name string, content []byte) error {
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+
+	header := tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(content)),
+		ModTime: time.Now(),
+	}
+	err := archive.WriteHeader(&header)
+	if (err != nil) {
+		return err
+	}
+	_, err = archive.Write(content)
+	if (err != nil) {
+		return err
+	}
+	err = archive.Close()
+	if (err != nil) {
+		return err
+	}
+
+	return cli.CopyToContainer(ctx, id, directory, &buf, types.CopyToContainerOptions{})
 }
 
 // Get the result of a build. Blocks until the build is complete.
-func check_result(cli *client.Client, ctx context.Context, id string) error {
+func check_result(cli *client.Client, ctx context.Context, id, log_file string) error {
 	statusC, errC := cli.ContainerWait(ctx, id, container.WaitConditionNotRunning)
 
-	sigC := make(chan os.Signal)
+	sigC := make(chan os.Signal, 1)
 	signal.Notify(sigC, os.Interrupt)
 
 	select {
@@ -91,29 +258,47 @@ func check_result(cli *client.Client, ctx context.Context, id string) error {
 
 	case status := <-statusC:
 		if status.StatusCode != 0 {
-			dump_logs(cli, ctx, id)
-			return errors.New("Build failed")
+			err := dump_logs(cli, ctx, id, log_file, true)
+			return errors.Join(errors.New("Build failed"), err)
 		}
 	}
 
-	return nil
+	return dump_logs(cli, ctx, id, log_file, false)
 }
 
-// Dump logs from a build.
-func dump_logs(cli *client.Client, ctx context.Context, id string) {
+// Dump logs from a build into a log file, and optionally to stdout as well.
+func dump_logs(cli *client.Client, ctx context.Context, id, log_file string, echo bool) error {
 	conf := types.ContainerLogsOptions{
 		ShowStdout: true,
+		ShowStderr: true,
 	}
 
 	out, err := cli.ContainerLogs(ctx, id, conf)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer out.Close()
 
-	scanner := bufio.NewScanner(out)
-	for scanner.Scan() {
-		fmt.Println(scanner.Text())
+	err = os.MkdirAll(path.Dir(log_file), 0755)
+	if (err != nil) {
+		return err
+	}
+
+	file, err := os.Create(log_file)
+	if (err != nil) {
+		return err
+	}
+	defer file.Close()
+
+	var w io.Writer = file
+	if (echo == true) {
+		w = io.MultiWriter(file, os.Stdout)
+	}
+
+	_, err = stdcopy.StdCopy(w, w, out)
+	if (err != nil) {
+		return fmt.Errorf("Cannot save the build log to %s: %s", log_file, err)
 	}
+	return file.Close()
 }
 
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	pattern_shell_safe = regexp.MustCompile(`^[A-Za-z0-9_./:=@,+-]+$`)
+)
+
+// Quote an argument so that a printed command can be pasted into a shell.
+func shell_quote(arg string) string {
+	if (pattern_shell_safe.MatchString(arg) == true) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// Format a command for printing.
+func format_command(name string, args ...string) string {
+	quoted := []string{name}
+	for _, arg := range args {
+		quoted = append(quoted, shell_quote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Print what build_packages would do. No containers are created, and the
+// repository, state files, history, and package sources are not touched.
+func describe_build(packages []Package, destination, arch, state_dir string, opts BuildOptions, resume bool) error {
+	if (len(packages) == 0) {
+		fmt.Println("Nothing to do")
+		return nil
+	}
+
+	targets := []string{}
+	for _, pkg := range packages {
+		target := target_name(pkg.Repository, arch)
+		if (find_string(&targets, target) != -1) {
+			continue
+		}
+		targets = append(targets, target)
+
+		local_dir := expected_apkdir(package_destination(destination, pkg), arch)
+		skip, err := skip_pull(state_dir, target, resume)
+		if (err != nil) {
+			return err
+		}
+		if (sync_mode == "none") {
+			fmt.Printf("Would not pull %s into %s (-sync none)\n", pkg.Repository, local_dir)
+			continue
+		} else if (skip == true) {
+			fmt.Printf("Would not pull %s into %s (packages were built but not pushed)\n", pkg.Repository, local_dir)
+			continue
+		}
+		fmt.Printf("Would pull %s into %s:\n", pkg.Repository, local_dir)
+		fmt.Printf("  %s\n", format_command("rsync", pull_arguments(pkg.Repository, local_dir, sync_mode)...))
+	}
+
+	states := map[string]*State{}
+
+	for _, pkg := range packages {
+		target := target_name(pkg.Repository, arch)
+		state, err := load_cached_state(states, state_filename(state_dir, target), target)
+		if (err != nil) {
+			return err
+		}
+
+		pkgdir := package_destination(destination, pkg)
+		local_dir := expected_apkdir(pkgdir, arch)
+		local_name := path.Join(local_dir, expected_apk(pkg))
+
+		if (resume == true) && (state.is_built(pkg, local_name) == true) {
+			fmt.Printf("Would skip building %s %s - already built\n", pkg.Name, pkg.Version)
+		} else {
+			describe_package_build(pkg, pkgdir, arch, opts)
+		}
+
+		describe_push(pkg, local_dir)
+	}
+
+	return nil
+}
+
+// Print how a Package would be built.
+func describe_package_build(pkg Package, pkgdir, arch string, opts BuildOptions) {
+	if (pkg.Message != "") {
+		fmt.Printf("Would build %s %s (%s):\n", pkg.Name, pkg.Version, pkg.Message)
+	} else {
+		fmt.Printf("Would build %s %s:\n", pkg.Name, pkg.Version)
+	}
+
+	if (pkg.Bumped == true) {
+		fmt.Printf("  bump pkgrel in %s\n", path.Join(pkg.Path, "APKBUILD"))
+	}
+
+	if (opts.Distfiles != "") {
+		for _, src := range parse_sources(pkg) {
+			if (src.URL == "") {
+				continue
+			}
+			filename := path.Join(opts.Distfiles, src.Name)
+			if (verify_checksum(filename, pkg.Checksums[src.Name]) == nil) {
+				fmt.Printf("  use cached %s\n", filename)
+			} else {
+				fmt.Printf("  fetch %s to %s\n", src.URL, filename)
+			}
+		}
+	}
+
+	conf, con_conf, plats := container_config(pkg, pkgdir, arch, opts)
+	fmt.Printf("  image: %s (pull %s)\n", conf.Image, opts.Image.Pull)
+	fmt.Printf("  platform: %s/%s\n", plats.OS, plats.Architecture)
+	if (opts.Cross == true) {
+		fmt.Printf("  cross-compile: if the Docker host is not %s, CHOST=%s in a container of its architecture, without the local repository\n", arch, apk_architecture(arch))
+	}
+	for _, m := range con_conf.Mounts {
+		fmt.Printf("  mount: %s -> %s\n", m.Source, m.Target)
+	}
+	fmt.Printf("  command: %s\n", strings.Join(conf.Cmd, " "))
+	for _, env := range conf.Env {
+		fmt.Printf("  environment: %s\n", env)
+	}
+	for _, repo := range opts.Repositories {
+		fmt.Printf("  apk repository: %s\n", repo)
+	}
+	if (opts.PublicKey != "") {
+		fmt.Printf("  apk key: %s -> %s\n", opts.PublicKey, path.Join("/etc/apk/keys", path.Base(opts.PublicKey)))
+	}
+
+	local_dir := expected_apkdir(pkgdir, arch)
+	fmt.Printf("  output: %s\n", path.Join(local_dir, expected_apk(pkg)))
+
+	index_name := path.Join(local_dir, "APKINDEX.tar.gz")
+	fmt.Printf("  index: add %s %s to %s\n", pkg.Name, pkg.Version, index_name)
+
+	// The index is only read if it was already pulled.
+	entries, err := read_apkindex(index_name)
+	if (err != nil) {
+		return
+	}
+	for _, entry := range entries {
+		if (entry.Name == pkg.Name) && (entry.Version != pkg.Version) {
+			fmt.Printf("  index: currently lists %s %s\n", entry.Name, entry.Version)
+		}
+	}
+}
+
+// Print how a Package would be pushed.
+func describe_push(pkg Package, local_dir string) {
+	fmt.Printf("Would push %s %s to %s:\n", pkg.Name, pkg.Version, pkg.Repository)
+	for _, local_name := range push_filenames(pkg, local_dir) {
+		fmt.Printf("  %s\n", format_command("rsync", local_name, pkg.Repository))
+	}
+}
+
+// Print what push_packages would do.
+func describe_pushes(packages []Package, destination, arch, state_dir string) error {
+	states := map[string]*State{}
+
+	for _, pkg := range packages {
+		target := target_name(pkg.Repository, arch)
+		state, err := load_cached_state(states, state_filename(state_dir, target), target)
+		if (err != nil) {
+			return err
+		}
+
+		local_dir := expected_apkdir(package_destination(destination, pkg), arch)
+		local_name := path.Join(local_dir, expected_apk(pkg))
+
+		if (state.is_built(pkg, local_name) == false) {
+			fmt.Printf("Skipping %s %s - not built\n", pkg.Name, pkg.Version)
+			continue
+		}
+
+		describe_push(pkg, local_dir)
+	}
+
+	return nil
+}
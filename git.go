@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Run `git(1)` in a directory and return stdout.
+func run_git(directory string, args ...string) (string, error) {
+	args = append([]string{"-C", directory}, args...)
+	logger("git").Debug("Running git", "args", args)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if (err != nil) {
+		return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// Find the top level of the git repository containing a directory.
+func git_toplevel(directory string) (string, error) {
+	out, err := run_git(directory, "rev-parse", "--show-toplevel")
+	if (err != nil) {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Find the commit that is checked out in a git repository.
+func git_head(directory string) (string, error) {
+	out, err := run_git(directory, "rev-parse", "HEAD")
+	if (err != nil) {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Find the branch that is checked out in a git repository, as a full ref.
+func git_branch(directory string) (string, error) {
+	out, err := run_git(directory, "symbolic-ref", "HEAD")
+	if (err != nil) {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Pull the git repositories of package source directories. Directories that
+// are not in a git repository are skipped.
+func pull_package_sources(roots []string) error {
+	pulled := []string{}
+
+	for _, root := range roots {
+		toplevel, err := git_toplevel(root)
+		if (err != nil) || (find_string(&pulled, toplevel) != -1) {
+			continue
+		}
+		pulled = append(pulled, toplevel)
+
+		logger("git").Info("Pulling", "repository", toplevel)
+		_, err = run_git(toplevel, "pull", "--ff-only")
+		if (err != nil) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Find the files under a directory that changed since a ref, including
+// uncommitted and untracked files. Paths are absolute.
+func git_changed_files(directory, ref string) ([]string, error) {
+	toplevel, err := git_toplevel(directory)
+	if (err != nil) {
+		return nil, err
+	}
+
+	changed, err := run_git(directory, "diff", "--name-only", ref, "--", ".")
+	if (err != nil) {
+		return nil, err
+	}
+
+	untracked, err := run_git(directory, "ls-files", "--others", "--exclude-standard", "--full-name", "--", ".")
+	if (err != nil) {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, name := range strings.Fields(changed + "\n" + untracked) {
+		files = append(files, path.Join(toplevel, name))
+	}
+	return files, nil
+}
+
+// Find the commits that the package sources were at for the last successful
+// run, keyed by the top level of each git repository. A run only records the
+// repositories of the packages it built, so older runs are used for the rest.
+func last_successful_commits(state_dir string) (map[string]string, error) {
+	runs, err := read_history(history_filename(state_dir))
+	if (err != nil) {
+		return nil, err
+	}
+
+	commits := map[string]string{}
+	for i := len(runs) - 1; i >= 0; i-- {
+		if (runs[i].Result != result_success) {
+			continue
+		}
+		for toplevel, commit := range runs[i].Commits {
+			_, ok := commits[toplevel]
+			if (ok == false) {
+				commits[toplevel] = commit
+			}
+		}
+	}
+
+	if (len(commits) == 0) {
+		return nil, errors.New("No successful run with a recorded commit in the history")
+	}
+	return commits, nil
+}
+
+// Record the commits that the package sources are at, keyed by the top level of
+// each git repository. Package sources that are not in a git repository are
+// ignored.
+func current_commits(packages []Package) map[string]string {
+	commits := map[string]string{}
+
+	for _, pkg := range packages {
+		toplevel, err := git_toplevel(pkg.Path)
+		if (err != nil) {
+			continue
+		}
+
+		_, ok := commits[toplevel]
+		if (ok == true) {
+			continue
+		}
+
+		head, err := git_head(toplevel)
+		if (err == nil) {
+			commits[toplevel] = head
+		}
+	}
+
+	return commits
+}
+
+// Find the package sources that changed since a ref. The ref can also be
+// `last-success`, to use the commits of the last successful run. A package
+// whose files changed without a change to pkgver or pkgrel is reported, since
+// the change would never be built.
+func find_changed_packages(packages []Package, ref, state_dir string) ([]string, error) {
+	commits := map[string]string{}
+	if (ref == "last-success") {
+		var err error
+		commits, err = last_successful_commits(state_dir)
+		if (err != nil) {
+			return nil, err
+		}
+	}
+
+	changed := []string{}
+	checked := map[string][]string{}
+	had_warnings := false
+
+	for _, pkg := range packages {
+		toplevel, err := git_toplevel(pkg.Path)
+		if (err != nil) {
+			return nil, err
+		}
+
+		base := ref
+		if (ref == "last-success") {
+			base = commits[toplevel]
+			if (base == "") {
+				return nil, fmt.Errorf("No successful run with a recorded commit for %s", toplevel)
+			}
+		}
+
+		// Diff each section (i.e. directory of package sources) only once.
+		section_dir := path.Dir(pkg.Path)
+		files, ok := checked[section_dir]
+		if (ok == false) {
+			files, err = git_changed_files(section_dir, base)
+			if (err != nil) {
+				return nil, err
+			}
+			checked[section_dir] = files
+		}
+
+		is_changed := false
+		for _, file := range files {
+			if (strings.HasPrefix(file, pkg.Path + "/") == true) {
+				is_changed = true
+				break
+			}
+		}
+		if (is_changed == false) {
+			continue
+		}
+		changed = append(changed, pkg.Name)
+		logger("git").Debug("Changed", "package", pkg.Name, "since", base)
+
+		relative := strings.TrimPrefix(path.Join(pkg.Path, "APKBUILD"), toplevel + "/")
+		old, err := run_git(toplevel, "show", base + ":" + relative)
+		if (err != nil) {
+			// The package source is new.
+			continue
+		}
+
+		variables, err := parse_variables(strings.NewReader(old), relative)
+		if (err != nil) {
+			return nil, err
+		}
+
+		if (variables["pkgver"] + "-r" + variables["pkgrel"] == pkg.Version) {
+			print_if(!had_warnings, "Warnings:")
+			had_warnings = true
+			fmt.Printf("%s %s - changed since %s without a new pkgver or pkgrel\n", pkg.Name, pkg.Version, base)
+		}
+	}
+
+	return changed, nil
+}
+
+// Restrict the queue to changed Packages. If a changed Package depends on an
+// out-of-date Package that did not change, building it would use a stale
+// dependency, so this is an error.
+func select_changed_packages(queue []Package, changed []string) ([]Package, error) {
+	selected := []Package{}
+	for _, pkg := range queue {
+		if (find_string(&changed, pkg.Name) != -1) {
+			selected = append(selected, pkg)
+		}
+	}
+
+	for _, pkg := range selected {
+		for _, dep := range pkg.Dependencies {
+			if (find_package(&queue, dep) != -1) && (find_package(&selected, dep) == -1) {
+				return nil, fmt.Errorf("Package %s depends on updated/new %s but it did not change", pkg.Name, dep)
+			}
+		}
+	}
+
+	return selected, nil
+}
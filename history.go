@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Packages that were built by an earlier run, and only pushed by a resumed
+// run, have the result "pushed".
+const (
+	result_success = "success"
+	result_failure = "failure"
+	result_pushed = "pushed"
+)
+
+// Options for the history command.
+var (
+	history_package string
+	history_failures bool
+	history_last int
+)
+
+// Run stores the result of a run of build_packages.
+type Run struct {
+	Target   string            `json:"target"`
+	Started  time.Time         `json:"started"`
+	Duration float64           `json:"duration"`
+	Result   string            `json:"result"`
+	Packages []RunPackage      `json:"packages"`
+	Commits  map[string]string `json:"commits,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// RunPackage stores the result of building a Package during a Run.
+type RunPackage struct {
+	Name     string  `json:"name"`
+	Version  string  `json:"version"`
+	Result   string  `json:"result"`
+	Duration float64 `json:"duration"`
+	Log      string  `json:"log,omitempty"`
+	Image    string  `json:"image,omitempty"`
+	Digest   string  `json:"digest,omitempty"`
+}
+
+func new_run(target string) Run {
+	return Run{Target: target, Started: time.Now(), Result: result_success, Packages: []RunPackage{}}
+}
+
+// Construct the history filename. There is a single history for all targets.
+func history_filename(state_dir string) string {
+	return path.Join(state_dir, "history.jsonl")
+}
+
+// Construct a log filename for a build of a Package.
+func log_filename(state_dir, target string, pkg Package) string {
+	name := fmt.Sprintf("%s-%s-%d.log", pkg.Name, pkg.Version, time.Now().Unix())
+	return path.Join(state_dir, "logs", target, name)
+}
+
+// Append a Run to the history.
+func append_history(filename string, run Run) error {
+	line, err := json.Marshal(run)
+	if (err != nil) {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(filename), 0755)
+	if (err != nil) {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if (err != nil) {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Read every Run from the history.
+func read_history(filename string) ([]Run, error) {
+	runs := []Run{}
+
+	file, err := os.Open(filename)
+	if (errors.Is(err, fs.ErrNotExist) == true) {
+		return runs, nil
+	} else if (err != nil) {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64 * 1024), 16 * 1024 * 1024)
+	for scanner.Scan() {
+		run := Run{}
+		err = json.Unmarshal(scanner.Bytes(), &run)
+		if (err != nil) {
+			return nil, fmt.Errorf("Cannot parse history file %s: %s", filename, err)
+		}
+		runs = append(runs, run)
+	}
+
+	err = scanner.Err()
+	if (err != nil) {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// Filter the history. If a package name is given, only Runs that built it are
+// kept, and only the matching RunPackage is kept in each. The last runs are
+// returned, newest first.
+func filter_history(runs []Run, target, name string, failures bool, last int) []Run {
+	filtered := []Run{}
+
+	for i := len(runs) - 1; i >= 0; i-- {
+		if (0 < last) && (last <= len(filtered)) {
+			break
+		}
+
+		run := runs[i]
+		// A run can build for multiple targets.
+		if (target != "") && (strings.Contains("," + run.Target + ",", "," + target + ",") == false) {
+			continue
+		}
+
+		if (name != "") {
+			pkgs := []RunPackage{}
+			for _, p := range run.Packages {
+				if (p.Name == name) {
+					pkgs = append(pkgs, p)
+				}
+			}
+			if (len(pkgs) == 0) {
+				continue
+			}
+			run.Packages = pkgs
+			run.Result = pkgs[len(pkgs) - 1].Result
+		}
+
+		if (failures == true) && (run.Result != result_failure) {
+			continue
+		}
+
+		filtered = append(filtered, run)
+	}
+
+	return filtered
+}
+
+// Print Runs.
+func print_history(runs []Run) {
+	if (len(runs) == 0) {
+		fmt.Println("No runs recorded")
+		return
+	}
+
+	for _, run := range runs {
+		duration := time.Duration(run.Duration * float64(time.Second)).Round(time.Second)
+		fmt.Printf("%s %s %s (%s)\n", run.Started.Format(time.RFC3339), run.Target, run.Result, duration)
+		print_if(run.Error != "", "  error: " + run.Error)
+		for _, p := range run.Packages {
+			duration = time.Duration(p.Duration * float64(time.Second)).Round(time.Second)
+			fmt.Printf("  %s %s %s (%s)\n", p.Name, p.Version, p.Result, duration)
+			print_if(p.Image != "", "    image: " + p.Image)
+			print_if(p.Digest != "", "    digest: " + p.Digest)
+			print_if(p.Log != "", "    log: " + p.Log)
+		}
+	}
+}
+
+// Construct the target name to filter the history by, from a connection
+// string and an architecture. Returns "" if no connection string was given.
+func history_target_name(connection, arch string) (string, error) {
+	if (connection == "") {
+		return "", nil
+	}
+
+	repo, err := parse_repository(connection)
+	if (err != nil) {
+		return "", err
+	}
+	arch, err = parse_architecture(arch, repo)
+	if (err != nil) {
+		return "", err
+	}
+
+	return target_name(repo, arch), nil
+}
+
+// Query the history. This is the `history` command.
+func run_history(args []string) error {
+	target, err := history_target_name(repository, architecture)
+	if (err != nil) {
+		return err
+	}
+
+	runs, err := read_history(history_filename(clean_state(state_dir)))
+	if (err != nil) {
+		return err
+	}
+
+	print_history(filter_history(runs, target, history_package, history_failures, history_last))
+	return nil
+}
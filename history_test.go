@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHistoryTargetName(t *testing.T) {
+	tests := []struct {
+		connection string
+		arch       string
+		want       string
+	}{
+		{"", "", ""},
+		{"host:/var/alpine/v3.17/x86_64", "", "host_var_alpine_v3.17_x86_64_amd64"},
+		{"host:/var/alpine/v3.17/x86_64/", "detected from repository", "host_var_alpine_v3.17_x86_64_amd64"},
+		{"user@host:/var/pkgs", "arm64", "user_host_var_pkgs_arm64"},
+	}
+	for _, test := range tests {
+		got, err := history_target_name(test.connection, test.arch)
+		if (err != nil) {
+			t.Errorf("%s: %s", test.connection, err)
+		} else if (got != test.want) {
+			t.Errorf("%s: got %q, want %q", test.connection, got, test.want)
+		}
+
+		// The runs of a build are recorded under the same name.
+		if (test.connection != "") && (got != target_name(clean_repository(test.connection), clean_architecture(test.arch, test.connection))) {
+			t.Errorf("%s: %q does not match the target of a build", test.connection, got)
+		}
+	}
+
+	for _, connection := range []string{"host:var/pkgs", "host:/var/pkgs"} {
+		_, err := history_target_name(connection, "")
+		if (err == nil) {
+			t.Errorf("%s: expected an error", connection)
+		}
+	}
+}
+
+func TestFilterHistoryTarget(t *testing.T) {
+	runs := []Run{
+		{Target: "host_var_pkgs_x86_64_amd64", Result: result_success},
+		{Target: "host_var_pkgs_aarch64_arm64", Result: result_success},
+		{Target: "host_var_pkgs_x86_64_amd64,host_var_community_x86_64_amd64", Result: result_failure},
+	}
+
+	filtered := filter_history(runs, "host_var_pkgs_x86_64_amd64", "", false, 0)
+	if (len(filtered) != 2) || (filtered[0].Result != result_failure) || (filtered[1].Result != result_success) {
+		t.Errorf("got %+v", filtered)
+	}
+}
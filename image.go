@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	pull_always = "always"
+	pull_if_missing = "if-missing"
+	pull_never = "never"
+)
+
+// Docker Hub credentials are stored under this key in a Docker config file.
+const docker_hub_server = "https://index.docker.io/v1/"
+
+// ImageOptions stores the image that build containers are created from, when
+// it is pulled, and the digests it is pinned to. Pins are keyed by target (see
+// target_name), or by an empty string for every target.
+type ImageOptions struct {
+	Name string
+	Pull string
+	Pins map[string]string
+}
+
+// DockerConfig stores the parts of a Docker config file (usually
+// `~/.docker/config.json`) that are used to authenticate to registries.
+type DockerConfig struct {
+	Auths       map[string]registry.AuthConfig `json:"auths"`
+	CredsStore  string                         `json:"credsStore"`
+	CredHelpers map[string]string              `json:"credHelpers"`
+}
+
+// Construct the image reference to build packages for a repository and
+// architecture with. If the target is pinned, the tag is replaced with the
+// digest.
+func image_reference(opts ImageOptions, repo, arch string) string {
+	digest, ok := opts.Pins[target_name(repo, arch)]
+	if (ok == false) {
+		digest, ok = opts.Pins[""]
+	}
+	if (ok == false) {
+		return opts.Name
+	}
+
+	named, err := reference.ParseNormalizedNamed(opts.Name)
+	if (err != nil) {
+		return opts.Name
+	}
+	return reference.TrimNamed(named).String() + "@" + digest
+}
+
+// Construct a local tag for the image of a platform, like
+// `registry.example.com/apkbuilder:latest-linux-arm64`. Pulling an image for
+// another platform moves its tag, so containers are created from these tags
+// instead, and images of several platforms can be present at once.
+func platform_tag(ref string, plats specs.Platform) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if (err != nil) {
+		return "", err
+	}
+
+	tag := "latest"
+	tagged, ok := named.(reference.Tagged)
+	if (ok == true) {
+		tag = tagged.Tag()
+	}
+	canonical, ok := named.(reference.Canonical)
+	if (ok == true) {
+		tag = canonical.Digest().Encoded()
+	}
+
+	return reference.TrimNamed(named).String() + ":" + tag + "-" + plats.OS + "-" + plats.Architecture, nil
+}
+
+// Check if an image is present for a platform.
+func has_image(cli *client.Client, ctx context.Context, ref string, plats specs.Platform) (bool, error) {
+	info, _, err := cli.ImageInspectWithRaw(ctx, ref)
+	if (err != nil) && (client.IsErrNotFound(err) == true) {
+		return false, nil
+	} else if (err != nil) {
+		return false, err
+	}
+	return (info.Os == plats.OS) && (info.Architecture == plats.Architecture), nil
+}
+
+// Make sure that an image is present for a platform, pulling it according to
+// a policy. Returns the platform tag (see platform_tag) to create containers
+// from.
+func ensure_image(cli *client.Client, ctx context.Context, ref, policy string, plats specs.Platform) (string, error) {
+	local, err := platform_tag(ref, plats)
+	if (err != nil) {
+		return "", err
+	}
+
+	if (policy != pull_always) {
+		found, err := has_image(cli, ctx, local, plats)
+		if (err != nil) || (found == true) {
+			return local, err
+		}
+
+		// The image might have been pulled without a platform tag.
+		found, err = has_image(cli, ctx, ref, plats)
+		if (err != nil) {
+			return "", err
+		} else if (found == true) {
+			return local, cli.ImageTag(ctx, ref, local)
+		} else if (policy == pull_never) {
+			return "", fmt.Errorf("Image %s is not present for %s/%s, and -pull is never", ref, plats.OS, plats.Architecture)
+		}
+	}
+
+	err = pull_image(cli, ctx, ref, plats)
+	if (err != nil) {
+		return "", err
+	}
+
+	found, err := has_image(cli, ctx, ref, plats)
+	if (err != nil) {
+		return "", err
+	} else if (found == false) {
+		return "", fmt.Errorf("Image %s has no %s/%s variant", ref, plats.OS, plats.Architecture)
+	}
+	return local, cli.ImageTag(ctx, ref, local)
+}
+
+// Pull an image, authenticating with the credentials from the Docker config.
+func pull_image(cli *client.Client, ctx context.Context, ref string, plats specs.Platform) error {
+	auth, err := registry_auth(ref)
+	if (err != nil) {
+		return err
+	}
+
+	logger("docker").Info("Pulling", "image", ref, "platform", plats.OS + "/" + plats.Architecture)
+	opts := types.ImagePullOptions{
+		RegistryAuth: auth,
+		Platform: plats.OS + "/" + plats.Architecture,
+	}
+
+	out, err := cli.ImagePull(ctx, ref, opts)
+	if (err != nil) {
+		return fmt.Errorf("Cannot pull %s: %s", ref, err)
+	}
+	defer out.Close()
+
+	// Errors during the pull are reported in the progress stream.
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		message := struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}{}
+		if (json.Unmarshal(scanner.Bytes(), &message) != nil) {
+			continue
+		}
+		if (message.Error != "") {
+			return fmt.Errorf("Cannot pull %s: %s", ref, message.Error)
+		}
+		logger("docker").Debug("Pulling", "image", ref, "status", message.Status)
+	}
+	return scanner.Err()
+}
+
+// Find the registry digest of a local image, like `sha256:...`. Returns an
+// empty string if the image was not pulled from a registry.
+func image_digest(cli *client.Client, ctx context.Context, ref, id string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if (err != nil) {
+		return "", err
+	}
+	canonical, ok := named.(reference.Canonical)
+	if (ok == true) {
+		return canonical.Digest().String(), nil
+	}
+
+	info, _, err := cli.ImageInspectWithRaw(ctx, id)
+	if (err != nil) {
+		return "", err
+	}
+
+	for _, repo_digest := range info.RepoDigests {
+		parsed, err := reference.ParseNormalizedNamed(repo_digest)
+		if (err != nil) {
+			continue
+		}
+		canonical, ok := parsed.(reference.Canonical)
+		if (ok == true) && (parsed.Name() == named.Name()) {
+			return canonical.Digest().String(), nil
+		}
+	}
+	return "", nil
+}
+
+// Construct the filename of the Docker config.
+func docker_config_filename() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if (dir == "") {
+		home, err := os.UserHomeDir()
+		if (err != nil) {
+			return ""
+		}
+		dir = path.Join(home, ".docker")
+	}
+	return path.Join(dir, "config.json")
+}
+
+// Read the Docker config. A missing config is not an error.
+func read_docker_config(filename string) (DockerConfig, error) {
+	config := DockerConfig{}
+
+	content, err := os.ReadFile(filename)
+	if (errors.Is(err, fs.ErrNotExist) == true) || (filename == "") {
+		return config, nil
+	} else if (err != nil) {
+		return config, err
+	}
+
+	err = json.Unmarshal(content, &config)
+	if (err != nil) {
+		return config, fmt.Errorf("Cannot parse %s: %s", filename, err)
+	}
+	return config, nil
+}
+
+// Find the credentials for the registry of an image in the Docker config, and
+// encode them for the Docker API. Credential helpers are used like `docker(1)`
+// would. Returns an empty string if there are no credentials.
+func registry_auth(ref string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if (err != nil) {
+		return "", err
+	}
+	server := reference.Domain(named)
+	if (server == "docker.io") {
+		server = docker_hub_server
+	}
+
+	config, err := read_docker_config(docker_config_filename())
+	if (err != nil) {
+		return "", err
+	}
+
+	auth := registry.AuthConfig{}
+	helper, ok := config.CredHelpers[server]
+	if (ok == false) {
+		auth, ok = config.Auths[server]
+		if (ok == false) {
+			auth, ok = config.Auths["https://" + server]
+		}
+		if (ok == false) {
+			helper = config.CredsStore
+		}
+	}
+
+	if (helper != "") {
+		auth, err = credential_helper(helper, server)
+		if (err != nil) {
+			return "", err
+		}
+	} else if (auth.Auth != "") {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if (err != nil) {
+			return "", fmt.Errorf("Cannot decode credentials for %s: %s", server, err)
+		}
+		auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		auth.Auth = ""
+	}
+
+	if (auth.Username == "") && (auth.IdentityToken == "") && (auth.RegistryToken == "") {
+		return "", nil
+	}
+
+	logger("docker").Debug("Using credentials", "registry", server, "username", auth.Username)
+	auth.ServerAddress = server
+	return registry.EncodeAuthConfig(auth)
+}
+
+// Get credentials from a credential helper, like `docker-credential-pass`.
+func credential_helper(helper, server string) (registry.AuthConfig, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-" + helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if (err != nil) {
+		// Helpers report missing credentials on stdout.
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		if (strings.Contains(message, "credentials not found") == true) {
+			return registry.AuthConfig{}, nil
+		}
+		return registry.AuthConfig{}, fmt.Errorf("docker-credential-%s: %s", helper, message)
+	}
+
+	creds := struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}{}
+	err = json.NewDecoder(io.LimitReader(&stdout, 1024 * 1024)).Decode(&creds)
+	if (err != nil) {
+		return registry.AuthConfig{}, fmt.Errorf("docker-credential-%s: %s", helper, err)
+	}
+
+	// Identity tokens are returned with this placeholder username.
+	if (creds.Username == "<token>") {
+		return registry.AuthConfig{IdentityToken: creds.Secret}, nil
+	}
+	return registry.AuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
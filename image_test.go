@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestImageReference(t *testing.T) {
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	other := "sha256:" + "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+
+	tests := []struct {
+		name string
+		opts ImageOptions
+		repo string
+		arch string
+		want string
+	}{
+		{
+			"unpinned",
+			clean_image_options("alpine:3.19", pull_if_missing, "", "amd64"),
+			"host:/var/pkgs/", "amd64",
+			"alpine:3.19",
+		},
+		{
+			"pinned for every target",
+			clean_image_options("alpine:3.19", pull_if_missing, digest, "amd64"),
+			"host:/var/pkgs/", "amd64",
+			"docker.io/library/alpine@" + digest,
+		},
+		{
+			"pinned for the target",
+			clean_image_options("registry.example.com/apkbuilder:latest", pull_if_missing, digest + ",host:/var/pkgs=" + other, "arm64"),
+			"host:/var/pkgs/", "arm64",
+			"registry.example.com/apkbuilder@" + other,
+		},
+		{
+			"pinned for another architecture",
+			clean_image_options("registry.example.com/apkbuilder:latest", pull_if_missing, "host:/var/pkgs=" + other, "arm64"),
+			"host:/var/pkgs/", "amd64",
+			"registry.example.com/apkbuilder:latest",
+		},
+		{
+			"pinned for another repository",
+			clean_image_options("registry.example.com/apkbuilder:latest", pull_if_missing, "host:/var/other=" + other, "amd64"),
+			"host:/var/pkgs/", "amd64",
+			"registry.example.com/apkbuilder:latest",
+		},
+	}
+
+	for _, test := range tests {
+		got := image_reference(test.opts, test.repo, test.arch)
+		if (got != test.want) {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPlatformTag(t *testing.T) {
+	digest := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	arm64 := specs.Platform{OS: "linux", Architecture: "arm64"}
+
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"alpine", "docker.io/library/alpine:latest-linux-arm64"},
+		{"alpine:3.19", "docker.io/library/alpine:3.19-linux-arm64"},
+		{"registry.example.com:5000/apkbuilder:latest", "registry.example.com:5000/apkbuilder:latest-linux-arm64"},
+		{"registry.example.com/apkbuilder@sha256:" + digest, "registry.example.com/apkbuilder:" + digest + "-linux-arm64"},
+		{"registry.example.com/apkbuilder:latest@sha256:" + digest, "registry.example.com/apkbuilder:" + digest + "-linux-arm64"},
+	}
+
+	for _, test := range tests {
+		got, err := platform_tag(test.ref, arm64)
+		if (err != nil) {
+			t.Errorf("%s: %s", test.ref, err)
+		} else if (got != test.want) {
+			t.Errorf("%s: got %s, want %s", test.ref, got, test.want)
+		}
+	}
+}
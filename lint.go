@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	pattern_alpine_version = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*[a-z]?(_(alpha|beta|pre|rc|cvs|svn|git|hg|p)[0-9]*)*$`)
+)
+
+// LintProblem stores a problem found in a package source.
+type LintProblem struct {
+	Package string `json:"package"`
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+func new_lint_problem(name, check, format string, a ...any) LintProblem {
+	return LintProblem{name, check, fmt.Sprintf(format, a...)}
+}
+
+// Check package sources for common problems. Dependencies are only checked if
+// a repository listing is given, since they can be satisfied by it.
+func lint_package_sources(packages []Package, source_errors []SourceError, repository []Package) []LintProblem {
+	problems := []LintProblem{}
+
+	for _, e := range source_errors {
+		problems = append(problems, new_lint_problem(e.Name, "parse", "%s", e.Err))
+	}
+
+	for i, pkg := range packages {
+		problems = append(problems, lint_variables(pkg)...)
+		problems = append(problems, lint_sources(pkg)...)
+
+		for j := 0; j < i; j++ {
+			if (packages[j].Variables["pkgname"] == pkg.Variables["pkgname"]) && (pkg.Variables["pkgname"] != "") {
+				problems = append(problems, new_lint_problem(pkg.Name, "duplicate", "pkgname %s is also used by %s", pkg.Variables["pkgname"], packages[j].Path))
+			}
+		}
+
+		if (repository == nil) {
+			continue
+		}
+		for _, dep := range pkg.Dependencies {
+			// Conflicts and providers (e.g. `so:libc.musl-x86_64.so.1`) can't
+			// be checked against a listing.
+			if (strings.HasPrefix(dep, "!") == true) || (strings.Contains(dep, ":") == true) {
+				continue
+			}
+			name := strip_constraint(dep)
+			if (find_package(&packages, name) == -1) && (find_package(&repository, name) == -1) {
+				problems = append(problems, new_lint_problem(pkg.Name, "depends", "dependency %s is not a package source or in the repository", dep))
+			}
+		}
+	}
+
+	return problems
+}
+
+// Check the variables of a package source.
+func lint_variables(pkg Package) []LintProblem {
+	problems := []LintProblem{}
+
+	for _, required := range []string{"pkgname", "pkgdesc", "url", "license", "arch"} {
+		if (strings.TrimSpace(pkg.Variables[required]) == "") {
+			problems = append(problems, new_lint_problem(pkg.Name, "missing", "%s is missing", required))
+		}
+	}
+
+	pkgname := pkg.Variables["pkgname"]
+	if (pkgname != "") && (pkgname != pkg.Name) {
+		problems = append(problems, new_lint_problem(pkg.Name, "pkgname", "pkgname %s does not match the directory", pkgname))
+	}
+
+	pkgver := pkg.Variables["pkgver"]
+	if (pattern_alpine_version.MatchString(pkgver) == false) {
+		problems = append(problems, new_lint_problem(pkg.Name, "pkgver", "pkgver %s is not a valid version", pkgver))
+	}
+
+	pkgrel := pkg.Variables["pkgrel"]
+	rel, err := strconv.Atoi(pkgrel)
+	if (err != nil) || (rel < 0) {
+		problems = append(problems, new_lint_problem(pkg.Name, "pkgrel", "pkgrel %s is not a non-negative integer", pkgrel))
+	}
+
+	return problems
+}
+
+// Check the sources of a package source against `sha512sums=` and the files in
+// the directory.
+func lint_sources(pkg Package) []LintProblem {
+	problems := []LintProblem{}
+
+	referenced := map[string]bool{"APKBUILD": true}
+	for _, install := range strings.Fields(pkg.Variables["install"]) {
+		referenced[install] = true
+	}
+
+	for _, src := range parse_sources(pkg) {
+		referenced[src.Name] = true
+		_, ok := pkg.Checksums[src.Name]
+		if (ok == false) {
+			problems = append(problems, new_lint_problem(pkg.Name, "sha512sums", "%s has no sha512sums entry", src.Name))
+		}
+	}
+
+	names := []string{}
+	for name, _ := range pkg.Checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if (referenced[name] == false) {
+			problems = append(problems, new_lint_problem(pkg.Name, "sha512sums", "sha512sums entry for %s is not in source", name))
+		}
+	}
+
+	members, err := os.ReadDir(pkg.Path)
+	if (err != nil) {
+		return append(problems, new_lint_problem(pkg.Name, "parse", "%s", err))
+	}
+	for _, member := range members {
+		if (member.Type().IsRegular() == true) && (referenced[member.Name()] == false) {
+			problems = append(problems, new_lint_problem(pkg.Name, "unreferenced", "%s is not referenced by source", path.Join(pkg.Name, member.Name())))
+		}
+	}
+
+	return problems
+}
+
+// Print LintProblems as human-readable text.
+func print_lint_problems(problems []LintProblem) {
+	for _, p := range problems {
+		fmt.Printf("%s: %s (%s)\n", p.Package, p.Message, p.Check)
+	}
+}
+
+// Print LintProblems as JSON.
+func print_lint_problems_json(problems []LintProblem) error {
+	out, err := json.MarshalIndent(problems, "", "  ")
+	if (err != nil) {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
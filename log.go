@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Options for logging.
+var (
+	log_level string
+	log_format string
+)
+
+// Configure the default logger. Logs are written to stderr, so that they do not
+// mix with output. Passing -verbose is the same as `-log-level debug`.
+func configure_logging(level, format string, verbose bool) error {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if (err != nil) {
+		return fmt.Errorf("Log level %s is not valid", level)
+	}
+	if (verbose == true) {
+		lvl = slog.LevelDebug
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	if (format == "text") {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	} else if (format == "json") {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	} else {
+		return fmt.Errorf("Log format %s is not valid", format)
+	}
+
+	return nil
+}
+
+// Get the logger of a subsystem (e.g. `rsync`).
+func logger(subsystem string) *slog.Logger {
+	return slog.Default().With("subsystem", subsystem)
+}
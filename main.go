@@ -1,18 +1,57 @@
 package main
 
 import (
-	"flag"
+	"errors"
 	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
 )
 
+// Options shared by the commands. See cli.go for the flags that set them.
 var (
-	verbose = flag.Bool("verbose", false, "Show debugging messages")
-	build = flag.Bool("build", false, "Build packages")
-	summary = flag.Bool("summary", false, "Summarize packages to build")
-	source = flag.String("source", "./src", "Directory of package sources")
-	destination = flag.String("destination", "./pkg", "Directory of packages")
-	architecture = flag.String("architecture", "detected from repository", "architecture to build")
-	repository = flag.String("repository", "", "Connection string for the remote package repository")
+	verbose bool
+	build bool
+	summary bool
+	source string
+	destination string
+	architecture string
+	repository string
+	only string
+	exclude string
+	with_deps bool
+	with_rdeps bool
+	force bool
+	bump_pkgrel bool
+	state_dir string
+	resume bool
+	remote bool
+	checksums bool
+	keep int
+	newer_than string
+	signing_key string
+	dry_run bool
+	sync_mode string
+	local_repository bool
+	container_repositories string
+	public_key string
+	distfiles string
+	image_name string
+	pull_policy string
+	pin_image string
+	cross bool
+	json_output bool
+	changed_since string
+	changed_only bool
+	notify_email string
+	smtp_server string
+	smtp_from string
+	notify_webhook string
+	notify_exec string
+	notify_on string
+	depth int
+	sections string
 )
 
 // Conditionally print a string.
@@ -22,56 +61,83 @@ func print_if(condition bool, str string) {
 	}
 }
 
-// Print debugging information if -verbose was passed to the program.
-func debug(str string) {
-	print_if(*verbose, str)
-}
-
-// Identify Packages in the package source directory.
-func list_package_sources(local_dir string) ([]Package, error) {
-	packages, err := walk_package_sources(local_dir)
+// Identify Packages in the package source directories.
+func list_package_sources(local_dirs []string, depth int) ([]Package, error) {
+	packages, err := walk_package_sources(local_dirs, depth)
 	if (err != nil) {
 		return nil, err
 	}
 
-	if (*verbose == true) {
-		dump_apkbuilds(packages, "DEBUG-MAIN")
-	}
-
+	dump_apkbuilds(packages, "pkgsrc")
 	return packages, nil
 }
 
 // Identify Packages in the repository.
 func list_repository(remote_dir string) ([]Package, error) {
+	started := time.Now()
 	packages, err := fetch_repository_listing(remote_dir)
+	builder_metrics.observe_listing(remote_dir, time.Since(started))
 	if (err != nil) {
 		return nil, err
 	}
 
-	if (*verbose == true) {
-		dump_apkbuilds(packages, "DEBUG-MAIN")
-	}
+	dump_apkbuilds(packages, "rsync")
 
 	return packages, nil
 }
 
-// Compare Packages between the package source directory and the repository.
-func compare_lists(local_dir, remote_dir string) ([]Package, error) {
+// Compare Packages between the package source directories and the
+// repository. Packages in a section that is mapped to a different repository
+// are compared to that repository instead.
+func compare_lists(local_dirs []string, depth int, remote_dir string, sections map[string]string, sel Selection) ([]Package, error) {
 	queue := []Package{}
 	had_errors := false
 
-	package_sources, err := list_package_sources(local_dir)
+	package_sources, err := list_package_sources(local_dirs, depth)
 	if (err != nil) {
 		return nil, err
 	}
 
-	repository, err := list_repository(remote_dir)
+	err = check_selection(sel, package_sources)
 	if (err != nil) {
 		return nil, err
 	}
 
+	changed := []string{}
+	if (changed_since != "") {
+		changed, err = find_changed_packages(package_sources, changed_since, state_dir)
+		if (err != nil) {
+			return nil, err
+		}
+	} else if (changed_only == true) {
+		return nil, errors.New("-changed-only requires -changed-since")
+	}
+
+	repositories := map[string][]Package{}
+
 	for i, _ := range package_sources {
-		err = find_builds(&package_sources[i], &repository)
+		repo, mapped := sections[package_sources[i].Section]
+		if (mapped == true) {
+			package_sources[i].Repository = repo
+			package_sources[i].Subdirectory = package_sources[i].Section
+		} else {
+			package_sources[i].Repository = remote_dir
+		}
+
+		repository, ok := repositories[package_sources[i].Repository]
+		if (ok == false) {
+			repository, err = list_repository(package_sources[i].Repository)
+			if (err != nil) {
+				return nil, err
+			}
+			repositories[package_sources[i].Repository] = repository
+		}
+
+		if (sel.Force == true) && (sel.matches(package_sources[i].Name) == true) {
+			package_sources[i].Forced = true
+		}
+
+		err = find_builds(&package_sources[i], &repository, bump_pkgrel)
 		if (err != nil) {
 			return nil, err
 		}
@@ -92,6 +158,18 @@ func compare_lists(local_dir, remote_dir string) ([]Package, error) {
 		return nil, err
 	}
 
+	if (changed_only == true) {
+		queue, err = select_changed_packages(queue, changed)
+		if (err != nil) {
+			return nil, err
+		}
+	}
+
+	queue, err = select_packages(queue, sel)
+	if (err != nil) {
+		return nil, err
+	}
+
 	err = sort_queue(&queue)
 	if (err != nil) {
 		return nil, err
@@ -116,18 +194,290 @@ func sort_queue(packages *[]Package) error {
 	return nil
 }
 
-// Build Packages.
-func build_packages(packages []Package, source, destination, arch, repository string) error {
+// Construct the local directory that a Package is built into.
+func package_destination(destination string, pkg Package) string {
+	return path.Join(destination, pkg.Subdirectory)
+}
+
+// Build Packages. Progress is recorded in the state file of each target, so
+// that if a run is interrupted, a resumed run can push packages that were
+// built but not pushed. Each target is locked for the duration of the run. The
+// run is recorded in the history regardless of the result. Before anything
+// else, the architecture is checked to be buildable. With -dry-run, the run is
+// only described.
+func build_packages(packages []Package, destination, arch, state_dir string, opts BuildOptions, notify NotifyOptions, resume bool) error {
+	if (dry_run == true) {
+		return describe_build(packages, destination, arch, state_dir, opts, resume)
+	}
+	if (len(packages) == 0) {
+		return nil
+	}
+
+	run := new_run(strings.Join(list_targets(packages, arch), ","))
+	run.Commits = current_commits(packages)
+
+	host, err := check_platform(arch, packages[0].Repository, opts)
+	if (err == nil) {
+		opts.Host = host
+
+		var locks []string
+		locks, err = lock_and_pull(packages, destination, arch, state_dir, resume)
+		for _, lock := range locks {
+			defer release_lock(lock)
+		}
+	}
+
+	if (err == nil) {
+		err = build_and_push_packages(packages, destination, arch, state_dir, opts, notify, resume, &run)
+	}
+
+	return finish_run(run, err, state_dir, notify)
+}
+
+// Record the result of a Run in the history and send notifications. Runs that
+// failed before building, like when planning or pulling failed, are recorded
+// as well.
+func finish_run(run Run, err error, state_dir string, notify NotifyOptions) error {
+	if (err != nil) {
+		run.Result = result_failure
+		run.Error = err.Error()
+	}
+	run.Duration = time.Since(run.Started).Seconds()
+	if (run.Result == result_success) {
+		builder_metrics.set_last_success(time.Now())
+	}
+	notify.run_result(run)
+
+	return errors.Join(err, append_history(history_filename(state_dir), run))
+}
+
+// List the targets of Packages.
+func list_targets(packages []Package, arch string) []string {
+	targets := []string{}
+	for _, pkg := range packages {
+		target := target_name(pkg.Repository, arch)
+		if (find_string(&targets, target) == -1) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// Lock each target of Packages, and pull its repository. Returns the lock
+// files that were acquired, which must be released even if there is an error.
+func lock_and_pull(packages []Package, destination, arch, state_dir string, resume bool) ([]string, error) {
+	locks := []string{}
+	targets := []string{}
+
+	for _, pkg := range packages {
+		target := target_name(pkg.Repository, arch)
+		if (find_string(&targets, target) != -1) {
+			continue
+		}
+		targets = append(targets, target)
+
+		lock := lock_filename(state_dir, target)
+		err := acquire_lock(lock)
+		if (err != nil) {
+			return locks, err
+		}
+		locks = append(locks, lock)
+
+		// Pulling would replace the index that lists the packages that
+		// were built but not pushed.
+		skip, err := skip_pull(state_dir, target, resume)
+		if (err != nil) {
+			return locks, err
+		} else if (skip == true) {
+			logger("build").Info("Skipping pull, packages were built but not pushed", "repository", pkg.Repository)
+			continue
+		}
+
+		logger("build").Info("Pulling", "repository", pkg.Repository)
+		err = pull_repository(pkg.Repository, expected_apkdir(package_destination(destination, pkg), arch), sync_mode)
+		if (err != nil) {
+			return locks, err
+		}
+	}
+
+	return locks, nil
+}
+
+// Check if pulling the repository should be skipped for a target, because a
+// resumed run has packages that were built but not pushed.
+func skip_pull(state_dir, target string, resume bool) (bool, error) {
+	if (resume == false) {
+		return false, nil
+	}
+
+	state, err := load_state(state_filename(state_dir, target), target)
+	if (err != nil) {
+		return false, err
+	}
+	return state.has_unpushed(), nil
+}
+
+// Build and push each Package, recording results into the state files and
+// Run.
+func build_and_push_packages(packages []Package, destination, arch, state_dir string, opts BuildOptions, notify NotifyOptions, resume bool, run *Run) error {
+	states := map[string]*State{}
+
+	for _, pkg := range packages {
+		builder_status.building(pkg)
+
+		target := target_name(pkg.Repository, arch)
+		state_file := state_filename(state_dir, target)
+		state, err := load_cached_state(states, state_file, target)
+		if (err != nil) {
+			return err
+		}
+
+		pkgdir := package_destination(destination, pkg)
+		local_dir := expected_apkdir(pkgdir, arch)
+		local_name := path.Join(local_dir, expected_apk(pkg))
+
+		resumed := (resume == true) && (state.is_built(pkg, local_name) == true)
+		if (resumed == true) {
+			logger("build").Info("Skipping build, already built", "package", pkg.Name)
+		} else {
+			if (pkg.Bumped == true) {
+				logger("build").Info("Bumping", "package", pkg.Name, "version", pkg.Version)
+				err = write_pkgrel(pkg)
+				if (err != nil) {
+					return err
+				}
+			}
+
+			i := state.begin(pkg)
+			err = save_state(state_file, *state)
+			if (err != nil) {
+				return err
+			}
+
+			result := RunPackage{Name: pkg.Name, Version: pkg.Version, Result: result_failure}
+			result.Log = log_filename(state_dir, target, pkg)
+
+			checksum, err := build_and_verify_package(pkg, pkgdir, arch, opts, &result)
+			result.Duration = time.Since(state.Records[i].Started).Seconds()
+			if (err != nil) {
+				state.Records[i].Status = status_failed
+				(*run).Packages = append((*run).Packages, result)
+				builder_metrics.observe_build(pkg.Name, arch, result.Result, result.Duration)
+				notify.package_result(*run, result)
+				return errors.Join(err, save_state(state_file, *state))
+			}
+
+			result.Result = result_success
+			(*run).Packages = append((*run).Packages, result)
+			builder_metrics.observe_build(pkg.Name, arch, result.Result, result.Duration)
+			notify.package_result(*run, result)
+
+			state.Records[i].Status = status_built
+			state.Records[i].Checksum = checksum
+			state.Records[i].Built = time.Now()
+			err = save_state(state_file, *state)
+			if (err != nil) {
+				return err
+			}
+		}
+
+		logger("build").Info("Pushing", "package", pkg.Name, "repository", pkg.Repository)
+		started := time.Now()
+		err = push_package(pkg, local_dir, pkg.Repository)
+
+		// The build was recorded by an earlier run, but not the push.
+		if (resumed == true) {
+			result := RunPackage{Name: pkg.Name, Version: pkg.Version, Result: result_pushed}
+			result.Duration = time.Since(started).Seconds()
+			if (err != nil) {
+				result.Result = result_failure
+			}
+			(*run).Packages = append((*run).Packages, result)
+			notify.package_result(*run, result)
+		}
+		if (err != nil) {
+			return err
+		}
+
+		i := state.latest(pkg.Name)
+		state.Records[i].Status = status_pushed
+		state.Records[i].Pushed = time.Now()
+		err = save_state(state_file, *state)
+		if (err != nil) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fetch the sources of a Package, build it, and verify the result. Returns the
+// checksum of the built apk.
+func build_and_verify_package(pkg Package, pkgdir, arch string, opts BuildOptions, result *RunPackage) (string, error) {
+	if (opts.Distfiles != "") {
+		logger("build").Info("Fetching sources", "package", pkg.Name)
+		err := fetch_distfiles(pkg, opts.Distfiles)
+		if (err != nil) {
+			return "", err
+		}
+	}
+
+	logger("build").Info("Building", "package", pkg.Name, "version", pkg.Version)
+	image, digest, err := build_package(pkg, pkgdir, arch, opts, (*result).Log)
+	(*result).Image = image
+	(*result).Digest = digest
+	if (err != nil) {
+		return "", err
+	}
+
+	local_dir := expected_apkdir(pkgdir, arch)
+	err = verify_artifact(pkg, arch, local_dir)
+	if (err != nil) {
+		return "", err
+	}
+
+	return checksum_file(path.Join(local_dir, expected_apk(pkg)))
+}
+
+// Push Packages that were built but not pushed.
+func push_packages(packages []Package, destination, arch, state_dir string) error {
+	if (dry_run == true) {
+		return describe_pushes(packages, destination, arch, state_dir)
+	}
+
+	states := map[string]*State{}
+
 	for _, pkg := range packages {
-		debug(fmt.Sprintf("Building %s...", pkg.Name))
-		err := build_package(pkg, source, destination, arch)
+		target := target_name(pkg.Repository, arch)
+		state_file := state_filename(state_dir, target)
+		state, err := load_cached_state(states, state_file, target)
+		if (err != nil) {
+			return err
+		}
+
+		local_dir := expected_apkdir(package_destination(destination, pkg), arch)
+		local_name := path.Join(local_dir, expected_apk(pkg))
+
+		if (state.is_built(pkg, local_name) == false) {
+			fmt.Printf("Skipping %s %s - not built\n", pkg.Name, pkg.Version)
+			continue
+		}
+
+		err = verify_artifact(pkg, arch, local_dir)
 		if (err != nil) {
 			return err
 		}
 
-		debug(fmt.Sprintf("Pushing %s...", pkg.Name))
-		local_dir := expected_apkdir(destination, arch)
-		err = push_package(pkg, local_dir, repository)
+		logger("build").Info("Pushing", "package", pkg.Name, "repository", pkg.Repository)
+		err = push_package(pkg, local_dir, pkg.Repository)
+		if (err != nil) {
+			return err
+		}
+
+		i := state.latest(pkg.Name)
+		state.Records[i].Status = status_pushed
+		state.Records[i].Pushed = time.Now()
+		err = save_state(state_file, *state)
 		if (err != nil) {
 			return err
 		}
@@ -145,29 +495,14 @@ func summarize_packages(packages []Package) {
 		for _, p := range packages {
 			fmt.Printf("  %s %s - %s\n", p.Name, p.Version, p.Message)
 		}
-		fmt.Println("To start building, pass the `-build` option")
+		fmt.Println("To start building, use the `build` command")
 	}
 }
 
 func main() {
-	flag.Parse()
-	src := clean_source(*source)
-	pkg := clean_destination(*destination)
-	repo := clean_repository(*repository)
-	arch := clean_architecture(*architecture, repo)
-
-	packages, err := compare_lists(src, repo)
+	err := dispatch(os.Args[1:])
 	if (err != nil) {
-		panic(err)
-	}
-
-	if (*build == true) {
-		err = build_packages(packages, src, pkg, arch, repo)
-		if (err != nil) {
-			panic(err)
-		}
-	} else {
-		summarize_packages(packages)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
-
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricInfo describes a metric in the Prometheus text format.
+type MetricInfo struct {
+	Name    string
+	Type    string
+	Help    string
+	Buckets []float64
+}
+
+// Metrics are written in this order.
+var metric_info = []MetricInfo{
+	{"simple_builder_builds_total", "counter", "Builds by result and architecture.", nil},
+	{"simple_builder_build_duration_seconds", "histogram", "Duration of builds by package.", []float64{30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}},
+	{"simple_builder_queue_length", "gauge", "Packages waiting to be built in the current run.", nil},
+	{"simple_builder_push_duration_seconds", "histogram", "Duration of pushes by repository.", []float64{1, 2, 5, 10, 30, 60, 120, 300}},
+	{"simple_builder_push_failures_total", "counter", "Failed pushes by repository.", nil},
+	{"simple_builder_listing_duration_seconds", "histogram", "Duration of repository listings by repository.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}},
+	{"simple_builder_last_success_timestamp_seconds", "gauge", "Time that the last successful run finished.", nil},
+}
+
+// Histogram stores observations in cumulative buckets.
+type Histogram struct {
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+// Metrics stores the values of every metric, keyed by name and then by
+// labels (in the text format, e.g. `result="success"`).
+type Metrics struct {
+	mutex      *sync.Mutex
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*Histogram
+}
+
+// The Metrics of this process.
+var builder_metrics = new_metrics()
+
+func new_metrics() Metrics {
+	return Metrics{&sync.Mutex{}, map[string]map[string]float64{}, map[string]map[string]*Histogram{}}
+}
+
+// Format labels for the text format. Arguments alternate between names and
+// values.
+func metric_labels(pairs ...string) string {
+	labels := []string{}
+	for i := 0; i + 1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i + 1])
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], value))
+	}
+	return strings.Join(labels, ",")
+}
+
+// Find a MetricInfo by name.
+func find_metric_info(name string) MetricInfo {
+	for _, info := range metric_info {
+		if (info.Name == name) {
+			return info
+		}
+	}
+	panic("Unknown metric " + name)
+}
+
+// Add to a counter.
+func (metrics Metrics) add(name, labels string, value float64) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	if (metrics.values[name] == nil) {
+		metrics.values[name] = map[string]float64{}
+	}
+	metrics.values[name][labels] += value
+}
+
+// Set a gauge.
+func (metrics Metrics) set(name, labels string, value float64) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	if (metrics.values[name] == nil) {
+		metrics.values[name] = map[string]float64{}
+	}
+	metrics.values[name][labels] = value
+}
+
+// Observe a value in a histogram.
+func (metrics Metrics) observe(name, labels string, value float64) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	buckets := find_metric_info(name).Buckets
+	if (metrics.histograms[name] == nil) {
+		metrics.histograms[name] = map[string]*Histogram{}
+	}
+	histogram, ok := metrics.histograms[name][labels]
+	if (ok == false) {
+		histogram = &Histogram{Counts: make([]uint64, len(buckets))}
+		metrics.histograms[name][labels] = histogram
+	}
+
+	for i, bound := range buckets {
+		if (value <= bound) {
+			histogram.Counts[i]++
+		}
+	}
+	histogram.Sum += value
+	histogram.Count++
+}
+
+// Record the result of a build.
+func (metrics Metrics) observe_build(name, arch, result string, duration float64) {
+	metrics.add("simple_builder_builds_total", metric_labels("result", result, "architecture", arch), 1)
+	metrics.observe("simple_builder_build_duration_seconds", metric_labels("package", name), duration)
+}
+
+// Record the result of a push.
+func (metrics Metrics) observe_push(remote_dir string, duration time.Duration, err error) {
+	labels := metric_labels("repository", remote_dir)
+	metrics.observe("simple_builder_push_duration_seconds", labels, duration.Seconds())
+	if (err != nil) {
+		metrics.add("simple_builder_push_failures_total", labels, 1)
+	}
+}
+
+// Record the duration of a repository listing.
+func (metrics Metrics) observe_listing(remote_dir string, duration time.Duration) {
+	metrics.observe("simple_builder_listing_duration_seconds", metric_labels("repository", remote_dir), duration.Seconds())
+}
+
+// Record that a run succeeded.
+func (metrics Metrics) set_last_success(finished time.Time) {
+	metrics.set("simple_builder_last_success_timestamp_seconds", "", float64(finished.Unix()))
+}
+
+// Restore metrics that should survive a restart from the history.
+func restore_metrics(state_dir string) {
+	runs, err := read_history(history_filename(state_dir))
+	if (err != nil) {
+		return
+	}
+
+	for i := len(runs) - 1; i >= 0; i-- {
+		if (runs[i].Result == result_success) && (runs[i].Started.IsZero() == false) {
+			finished := runs[i].Started.Add(time.Duration(runs[i].Duration * float64(time.Second)))
+			builder_metrics.set_last_success(finished)
+			return
+		}
+	}
+}
+
+// Write every metric in the Prometheus text format.
+func (metrics Metrics) write(w io.Writer) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	for _, info := range metric_info {
+		fmt.Fprintf(w, "# HELP %s %s\n", info.Name, info.Help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", info.Name, info.Type)
+
+		for _, labels := range sorted_keys(metrics.values[info.Name]) {
+			fmt.Fprintf(w, "%s %s\n", metric_name(info.Name, labels), format_metric(metrics.values[info.Name][labels]))
+		}
+
+		histograms := metrics.histograms[info.Name]
+		for _, labels := range sorted_keys(histograms) {
+			histogram := histograms[labels]
+			for i, bound := range info.Buckets {
+				le := metric_labels("le", format_metric(bound))
+				fmt.Fprintf(w, "%s %d\n", metric_name(info.Name + "_bucket", join_labels(labels, le)), histogram.Counts[i])
+			}
+			fmt.Fprintf(w, "%s %d\n", metric_name(info.Name + "_bucket", join_labels(labels, `le="+Inf"`)), histogram.Count)
+			fmt.Fprintf(w, "%s %s\n", metric_name(info.Name + "_sum", labels), format_metric(histogram.Sum))
+			fmt.Fprintf(w, "%s %d\n", metric_name(info.Name + "_count", labels), histogram.Count)
+		}
+	}
+}
+
+// Sort the keys of a map of labels, so that output is stable.
+func sorted_keys[V any](values map[string]V) []string {
+	keys := []string{}
+	for key, _ := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Construct a metric name with labels, like `name{label="value"}`.
+func metric_name(name, labels string) string {
+	if (labels == "") {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+// Join two sets of labels.
+func join_labels(a, b string) string {
+	if (a == "") {
+		return b
+	}
+	return a + "," + b
+}
+
+// Format a value for the text format.
+func format_metric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Handle `GET /metrics`.
+func handle_metrics(w http.ResponseWriter, r *http.Request) {
+	builder_metrics.set("simple_builder_queue_length", "", float64(len(builder_status.snapshot().Queue)))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	builder_metrics.write(w)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	notify_all = "all"
+	notify_failure = "failure"
+)
+
+// Notifier sends the result of each Package and of each Run somewhere.
+type Notifier interface {
+	notify_package(run Run, result RunPackage) error
+	notify_run(run Run) error
+}
+
+// NotifyOptions stores the Notifiers to send results to, and whether to send
+// every result or only failures.
+type NotifyOptions struct {
+	Notifiers []Notifier
+	On        string
+}
+
+// EmailNotifier sends an email through an SMTP server at the end of a Run.
+// Results of Packages are included in it, rather than sent separately.
+type EmailNotifier struct {
+	Server   string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+// WebhookNotifier POSTs each result as JSON to a URL.
+type WebhookNotifier struct {
+	URL string
+}
+
+// ExecNotifier runs a command for each result, with the result in
+// environment variables.
+type ExecNotifier struct {
+	Command string
+}
+
+// Notification is the JSON body sent by a WebhookNotifier.
+type Notification struct {
+	Event   string      `json:"event"`
+	Run     Run         `json:"run"`
+	Package *RunPackage `json:"package,omitempty"`
+}
+
+// Send the result of a Package to every Notifier. If only failures are
+// notified, successes are skipped. Notifiers that fail are reported, but do
+// not fail the Run.
+func (opts NotifyOptions) package_result(run Run, result RunPackage) {
+	if (opts.On == notify_failure) && (result.Result != result_failure) {
+		return
+	}
+
+	for _, notifier := range opts.Notifiers {
+		err := notifier.notify_package(run, result)
+		if (err != nil) {
+			logger("notify").Error("Cannot send notification", "error", err)
+		}
+	}
+}
+
+// Send the result of a Run to every Notifier. See package_result.
+func (opts NotifyOptions) run_result(run Run) {
+	if (opts.On == notify_failure) && (run.Result != result_failure) {
+		return
+	}
+
+	for _, notifier := range opts.Notifiers {
+		err := notifier.notify_run(run)
+		if (err != nil) {
+			logger("notify").Error("Cannot send notification", "error", err)
+		}
+	}
+}
+
+// Summarize a Run as text.
+func describe_run(run Run) string {
+	var text strings.Builder
+
+	duration := time.Duration(run.Duration * float64(time.Second)).Round(time.Second)
+	fmt.Fprintf(&text, "Run for %s started at %s: %s (%s)\n\n", run.Target, run.Started.Format(time.RFC3339), run.Result, duration)
+	if (run.Error != "") {
+		fmt.Fprintf(&text, "%s\n\n", run.Error)
+	}
+	for _, p := range run.Packages {
+		duration = time.Duration(p.Duration * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(&text, "%s %s %s (%s)\n", p.Name, p.Version, p.Result, duration)
+		if (p.Log != "") {
+			fmt.Fprintf(&text, "  log: %s\n", p.Log)
+		}
+	}
+
+	return text.String()
+}
+
+func (notifier EmailNotifier) notify_package(run Run, result RunPackage) error {
+	return nil
+}
+
+func (notifier EmailNotifier) notify_run(run Run) error {
+	subject := fmt.Sprintf("simple-builder: %s for %s", run.Result, run.Target)
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", notifier.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(notifier.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(describe_run(run), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if (notifier.Username != "") {
+		host, _, _ := strings.Cut(notifier.Server, ":")
+		auth = smtp.PlainAuth("", notifier.Username, notifier.Password, host)
+	}
+
+	logger("notify").Debug("Sending email", "to", notifier.To)
+	return smtp.SendMail(notifier.Server, auth, notifier.From, notifier.To, message.Bytes())
+}
+
+func (notifier WebhookNotifier) notify_package(run Run, result RunPackage) error {
+	return notifier.post(Notification{"package", run, &result})
+}
+
+func (notifier WebhookNotifier) notify_run(run Run) error {
+	return notifier.post(Notification{"run", run, nil})
+}
+
+// POST a Notification.
+func (notifier WebhookNotifier) post(notification Notification) error {
+	body, err := json.Marshal(notification)
+	if (err != nil) {
+		return err
+	}
+
+	logger("notify").Debug("Posting notification", "event", notification.Event, "url", notifier.URL)
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(notifier.URL, "application/json", bytes.NewReader(body))
+	if (err != nil) {
+		return err
+	}
+	resp.Body.Close()
+
+	if (resp.StatusCode < 200) || (299 < resp.StatusCode) {
+		return fmt.Errorf("%s responded %s", notifier.URL, resp.Status)
+	}
+	return nil
+}
+
+func (notifier ExecNotifier) notify_package(run Run, result RunPackage) error {
+	return notifier.exec([]string{
+		"SIMPLE_BUILDER_EVENT=package",
+		"SIMPLE_BUILDER_TARGET=" + run.Target,
+		"SIMPLE_BUILDER_PACKAGE=" + result.Name,
+		"SIMPLE_BUILDER_VERSION=" + result.Version,
+		"SIMPLE_BUILDER_RESULT=" + result.Result,
+		fmt.Sprintf("SIMPLE_BUILDER_DURATION=%.0f", result.Duration),
+		"SIMPLE_BUILDER_LOG=" + result.Log,
+	})
+}
+
+func (notifier ExecNotifier) notify_run(run Run) error {
+	built := []string{}
+	failed := []string{}
+	for _, p := range run.Packages {
+		if (p.Result == result_failure) {
+			failed = append(failed, p.Name)
+		} else {
+			built = append(built, p.Name)
+		}
+	}
+
+	return notifier.exec([]string{
+		"SIMPLE_BUILDER_EVENT=run",
+		"SIMPLE_BUILDER_TARGET=" + run.Target,
+		"SIMPLE_BUILDER_RESULT=" + run.Result,
+		fmt.Sprintf("SIMPLE_BUILDER_DURATION=%.0f", run.Duration),
+		"SIMPLE_BUILDER_BUILT=" + strings.Join(built, " "),
+		"SIMPLE_BUILDER_FAILED=" + strings.Join(failed, " "),
+		"SIMPLE_BUILDER_ERROR=" + run.Error,
+	})
+}
+
+// Run the command with additional environment variables. Its output is
+// passed through.
+func (notifier ExecNotifier) exec(env []string) error {
+	logger("notify").Debug("Running hook", "command", notifier.Command)
+	cmd := exec.Command(notifier.Command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
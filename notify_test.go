@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// SMTPMessage stores an email received by a stub SMTP server.
+type SMTPMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// Serve a single SMTP session on a local port. The received message is sent
+// on the channel.
+func serve_smtp(t *testing.T) (string, <-chan SMTPMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan SMTPMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if (err != nil) {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) {
+			conn.Write([]byte(line + "\r\n"))
+		}
+
+		message := SMTPMessage{}
+		reply("220 localhost ESMTP stub")
+		for {
+			line, err := r.ReadString('\n')
+			if (err != nil) {
+				return
+			}
+			command := strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0])
+
+			switch verb {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL":
+				message.From = strings.Trim(strings.TrimPrefix(command, "MAIL FROM:"), "<>")
+				reply("250 OK")
+			case "RCPT":
+				message.To = append(message.To, strings.Trim(strings.TrimPrefix(command, "RCPT TO:"), "<>"))
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if (err != nil) {
+						return
+					}
+					if (line == ".\r\n") {
+						break
+					}
+					data.WriteString(line)
+				}
+				message.Data = data.String()
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				messages <- message
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), messages
+}
+
+func test_run() Run {
+	run := new_run("host_var_pkgs_amd64")
+	run.Result = result_failure
+	run.Duration = 62
+	run.Packages = []RunPackage{
+		{Name: "foo", Version: "1.2.3-r0", Result: result_success, Duration: 30},
+		{Name: "bar", Version: "0.1-r1", Result: result_failure, Duration: 32, Log: "state/logs/host_var_pkgs_amd64/bar-0.1-r1.log"},
+	}
+	return run
+}
+
+func TestEmailNotifier(t *testing.T) {
+	server, messages := serve_smtp(t)
+	notifier := EmailNotifier{server, "builder@example.com", []string{"me@example.com", "you@example.com"}, "", ""}
+
+	err := notifier.notify_run(test_run())
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	var message SMTPMessage
+	select {
+	case message = <-messages:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no email was received")
+	}
+
+	if (message.From != "builder@example.com") {
+		t.Errorf("got sender %q", message.From)
+	}
+	if (strings.Join(message.To, ",") != "me@example.com,you@example.com") {
+		t.Errorf("got recipients %q", message.To)
+	}
+
+	for _, want := range []string{
+		"To: me@example.com, you@example.com\r\n",
+		"Subject: simple-builder: failure for host_var_pkgs_amd64\r\n",
+		"foo 1.2.3-r0 success (30s)\r\n",
+		"bar 0.1-r1 failure (32s)\r\n",
+		"  log: state/logs/host_var_pkgs_amd64/bar-0.1-r1.log\r\n",
+	} {
+		if (strings.Contains(message.Data, want) == false) {
+			t.Errorf("email does not contain %q:\n%s", want, message.Data)
+		}
+	}
+}
+
+func TestEmailNotifierUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	server := listener.Addr().String()
+	listener.Close()
+
+	notifier := EmailNotifier{server, "builder@example.com", []string{"me@example.com"}, "", ""}
+	err = notifier.notify_run(test_run())
+	if (err == nil) {
+		t.Errorf("expected an error for an unreachable SMTP server")
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	received := []Notification{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notification := Notification{}
+		err := json.NewDecoder(r.Body).Decode(&notification)
+		if (err != nil) {
+			t.Error(err)
+		}
+		received = append(received, notification)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	opts := NotifyOptions{[]Notifier{WebhookNotifier{server.URL}}, notify_failure}
+	run := test_run()
+	for _, result := range run.Packages {
+		opts.package_result(run, result)
+	}
+	opts.run_result(run)
+
+	// Only failures are sent.
+	if (len(received) != 2) {
+		t.Fatalf("got %d notifications, want 2", len(received))
+	}
+	if (received[0].Event != "package") || (received[0].Package == nil) || ((*received[0].Package).Name != "bar") {
+		t.Errorf("got %+v, want the failure of bar", received[0])
+	}
+	if (received[1].Event != "run") || (received[1].Package != nil) || (len(received[1].Run.Packages) != 2) {
+		t.Errorf("got %+v, want the run", received[1])
+	}
+}
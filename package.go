@@ -5,16 +5,24 @@ type Package struct {
 	Name         string
 	Version      string
 	Dependencies []string
+	Sources      []string
+	Checksums    map[string]string
+	Variables    map[string]string
+	Path         string
+	Section      string
+	Repository   string
+	Subdirectory string
 	Message      string
 	Build        bool
+	Forced       bool
+	Bumped       bool
 	Error        bool
 }
 
 func new_package(name string) Package {
-	return Package{name, "", []string{}, "", false, false}
+	return Package{Name: name, Dependencies: []string{}}
 }
 
 func new_package_with_version(name, version string) Package {
-	return Package{name, version, []string{}, "", false, false}
+	return Package{Name: name, Version: version, Dependencies: []string{}}
 }
-
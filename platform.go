@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Handlers for foreign binaries are registered here.
+const binfmt_misc = "/proc/sys/fs/binfmt_misc"
+
+// Translate an architecture reported by `uname(1)` to the name used by Docker.
+func docker_architecture(machine string) string {
+	if (machine == "x86_64") {
+		return "amd64"
+	} else if (machine == "aarch64") {
+		return "arm64"
+	}
+	return machine
+}
+
+// Find an enabled binfmt_misc handler for an architecture (as named by apk,
+// e.g. `aarch64`). Only handlers with the fix-binary (F) flag work inside
+// containers, since the interpreter is not in the image. Returns an empty
+// string if there is none.
+func binfmt_handler(machine string) string {
+	status, err := os.ReadFile(path.Join(binfmt_misc, "status"))
+	if (err != nil) || (strings.TrimSpace(string(status)) != "enabled") {
+		return ""
+	}
+
+	entries, err := os.ReadDir(binfmt_misc)
+	if (err != nil) {
+		return ""
+	}
+
+	for _, entry := range entries {
+		if (entry.Name() == "status") || (entry.Name() == "register") {
+			continue
+		}
+
+		content, err := os.ReadFile(path.Join(binfmt_misc, entry.Name()))
+		if (err != nil) {
+			continue
+		}
+
+		enabled := false
+		interpreter := ""
+		flags := ""
+		for _, line := range strings.Split(string(content), "\n") {
+			if (line == "enabled") {
+				enabled = true
+			} else if (strings.HasPrefix(line, "interpreter ") == true) {
+				interpreter = strings.TrimPrefix(line, "interpreter ")
+			} else if (strings.HasPrefix(line, "flags: ") == true) {
+				flags = strings.TrimPrefix(line, "flags: ")
+			}
+		}
+
+		matches := strings.Contains(entry.Name(), machine) || strings.Contains(path.Base(interpreter), machine)
+		if (enabled == true) && (matches == true) && (strings.Contains(flags, "F") == true) {
+			return entry.Name()
+		}
+	}
+
+	return ""
+}
+
+// Check that build containers for an architecture can run on the Docker host,
+// before any build starts. Containers of a foreign architecture need emulation,
+// which is found by checking the binfmt_misc handlers of a local Docker host,
+// or else by running a probe container. With -cross, containers always run
+// natively, but the image needs a cross toolchain. Returns the architecture of
+// the Docker host.
+func check_platform(arch, repo string, opts BuildOptions) (string, error) {
+	ctx := context.Background()
+
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if (err != nil) {
+		return "", err
+	}
+
+	info, err := cli.Info(ctx)
+	if (err != nil) {
+		return "", err
+	}
+	host := docker_architecture(info.Architecture)
+
+	if (host == arch) {
+		return host, nil
+	} else if (opts.Cross == true) {
+		return host, check_cross(cli, ctx, host, arch, repo, opts)
+	}
+
+	if (strings.HasPrefix(cli.DaemonHost(), "unix://") == true) {
+		handler := binfmt_handler(apk_architecture(arch))
+		if (handler != "") {
+			logger("platform").Debug("Found emulation", "architecture", arch, "handler", handler)
+			return host, nil
+		}
+	}
+
+	plats := specs.Platform{Architecture: arch, OS: "linux"}
+	ref := image_reference(opts.Image, repo, arch)
+
+	local, err := ensure_image(cli, ctx, ref, opts.Image.Pull, plats)
+	if (err != nil) {
+		return host, err
+	}
+
+	logger("platform").Info("Probing emulation", "architecture", arch, "image", ref)
+	err = probe_platform(cli, ctx, local, plats, []string{"/bin/true"})
+	if (err != nil) {
+		return host, fmt.Errorf(
+			"Cannot run linux/%s containers on this Docker host (%s): %s\n" +
+			"Install QEMU user emulation for %s with binfmt_misc (e.g. `docker run --privileged --rm tonistiigi/binfmt --install %s`), " +
+			"or pass -cross to cross-compile with abuild instead",
+			arch, info.Architecture, err, apk_architecture(arch), arch,
+		)
+	}
+
+	return host, nil
+}
+
+// Check that the image has a cross toolchain and sysroot for an architecture.
+// Cross-compiling is experimental: the image has to provide both (e.g. built
+// with Alpine's `scripts/bootstrap.sh`), and packages built in the same run are
+// not available as dependencies.
+func check_cross(cli *client.Client, ctx context.Context, host, arch, repo string, opts BuildOptions) error {
+	plats := specs.Platform{Architecture: host, OS: "linux"}
+	ref := image_reference(opts.Image, repo, arch)
+
+	local, err := ensure_image(cli, ctx, ref, opts.Image.Pull, plats)
+	if (err != nil) {
+		return err
+	}
+
+	hostspec := cross_hostspec(arch)
+	logger("platform").Info("Probing cross toolchain", "architecture", arch, "image", ref)
+	err = probe_platform(cli, ctx, local, plats, []string{"/bin/sh", "-c", "command -v " + hostspec + "-gcc && test -d /usr/" + hostspec})
+	if (err != nil) {
+		return fmt.Errorf(
+			"Cannot cross-compile for %s with %s: %s\n" +
+			"-cross is experimental and needs an image with the %s-gcc toolchain and a sysroot in /usr/%s (e.g. from Alpine's scripts/bootstrap.sh), " +
+			"or else drop -cross to build with emulation",
+			arch, ref, err, hostspec, hostspec,
+		)
+	}
+	return nil
+}
+
+// Run a command in a container of a platform, and check that it succeeds.
+func probe_platform(cli *client.Client, ctx context.Context, ref string, plats specs.Platform, cmd []string) error {
+	conf := container.Config{
+		Image: ref,
+		Entrypoint: cmd,
+	}
+
+	con, err := cli.ContainerCreate(ctx, &conf, &container.HostConfig{}, nil, &plats, "")
+	if (err != nil) {
+		return err
+	}
+	defer cli.ContainerRemove(ctx, con.ID, types.ContainerRemoveOptions{Force: true})
+
+	err = cli.ContainerStart(ctx, con.ID, types.ContainerStartOptions{})
+	if (err != nil) {
+		return err
+	}
+
+	statusC, errC := cli.ContainerWait(ctx, con.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errC:
+		return err
+	case status := <-statusC:
+		if (status.Error != nil) {
+			return errors.New(status.Error.Message)
+		} else if (status.StatusCode != 0) {
+			return fmt.Errorf("probe container exited with status %d", status.StatusCode)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Decide which apks in a repository are superseded and should be removed. For
+// each package, the newest version is always kept. Older versions are kept if
+// they are among the newest `keep` versions, or if they were modified after
+// `newer_than` (unless it is zero).
+func plan_prune(files []RemoteFile, keep int, newer_than time.Time) ([]RemoteFile, error) {
+	versions := map[string][]RemoteFile{}
+	names := []string{}
+
+	for _, file := range files {
+		pkg, err := find_apk(file.Name)
+		if (err != nil) {
+			continue
+		}
+		if (len(versions[pkg.Name]) == 0) {
+			names = append(names, pkg.Name)
+		}
+		versions[pkg.Name] = append(versions[pkg.Name], file)
+	}
+	sort.Strings(names)
+
+	remove := []RemoteFile{}
+	for _, name := range names {
+		apks := versions[name]
+
+		// Sort newest first.
+		var err error
+		sort.SliceStable(apks, func(i, j int) bool {
+			a, _ := find_apk(apks[i].Name)
+			b, _ := find_apk(apks[j].Name)
+			diff, e := compare_versions(b.Version, a.Version)
+			if (e != nil) {
+				err = e
+			}
+			return (diff == 1)
+		})
+		if (err != nil) {
+			return nil, err
+		}
+
+		for i, file := range apks {
+			if (i == 0) || (i < keep) {
+				continue
+			}
+			if (newer_than.IsZero() == false) && (file.Modified.After(newer_than) == true) {
+				continue
+			}
+			remove = append(remove, file)
+		}
+	}
+
+	return remove, nil
+}
+
+// Remove superseded apks from a repository. The index is rewritten and pushed
+// first, so that it never refers to a removed apk.
+func prune_repository(remote_dir string, keep int, newer_than time.Time, key_name string, dry_run bool) error {
+	files, err := fetch_remote_files(remote_dir)
+	if (err != nil) {
+		return err
+	}
+
+	remove, err := plan_prune(files, keep, newer_than)
+	if (err != nil) {
+		return err
+	}
+
+	if (len(remove) == 0) {
+		fmt.Println("Nothing to prune")
+		return nil
+	}
+
+	removed := map[string]bool{}
+	for _, file := range remove {
+		removed[file.Name] = true
+		if (dry_run == true) {
+			fmt.Printf("Would remove %s (%s)\n", file.Name, file.Modified.Format("2006-01-02"))
+		} else {
+			fmt.Printf("Removing %s (%s)\n", file.Name, file.Modified.Format("2006-01-02"))
+		}
+	}
+
+	if (dry_run == true) {
+		return nil
+	}
+
+	tmp, err := os.MkdirTemp("", "simple-builder-")
+	if (err != nil) {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	err = fetch_file(remote_dir, "APKINDEX.tar.gz", tmp)
+	if (err != nil) {
+		return err
+	}
+
+	index_name := path.Join(tmp, "APKINDEX.tar.gz")
+	keep_entry := func(entry IndexEntry) bool {
+		return (removed[entry.filename()] == false)
+	}
+	err = rewrite_apkindex(index_name, index_name, keep_entry, key_name)
+	if (err != nil) {
+		return err
+	}
+
+	err = push_file(index_name, remote_dir)
+	if (err != nil) {
+		return err
+	}
+
+	names := []string{}
+	for _, file := range remove {
+		names = append(names, file.Name)
+	}
+
+	return delete_files(remote_dir, names)
+}
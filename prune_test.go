@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func test_remote_file(name string, day int) RemoteFile {
+	return RemoteFile{name, 1024, time.Date(2024, 3, day, 0, 0, 0, 0, time.Local)}
+}
+
+func TestPlanPrune(t *testing.T) {
+	// Listed in no particular order, like `rsync --list-only`.
+	files := []RemoteFile{
+		test_remote_file("APKINDEX.tar.gz", 20),
+		test_remote_file("foo-1.10-r0.apk", 10),
+		test_remote_file("foo-1.2-r0.apk", 2),
+		test_remote_file("bar-2.0-r1.apk", 5),
+		test_remote_file("foo-1.9-r0.apk", 9),
+		test_remote_file("foo-1.10-r1.apk", 15),
+		test_remote_file("bar-2.0-r0.apk", 4),
+		test_remote_file("baz-0.1-r0.apk", 1),
+	}
+
+	tests := []struct {
+		name       string
+		keep       int
+		newer_than time.Time
+		want       []string
+	}{
+		{"newest", 1, time.Time{}, []string{"bar-2.0-r0.apk", "foo-1.10-r0.apk", "foo-1.9-r0.apk", "foo-1.2-r0.apk"}},
+		{"keep 2", 2, time.Time{}, []string{"foo-1.9-r0.apk", "foo-1.2-r0.apk"}},
+		{"keep all", 4, time.Time{}, []string{}},
+		{"newer than", 1, time.Date(2024, 3, 5, 0, 0, 0, 0, time.Local), []string{"bar-2.0-r0.apk", "foo-1.2-r0.apk"}},
+		{"keep 2 and newer than", 2, time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local), []string{}},
+		// The newest version is kept even if it is old.
+		{"keep 0", 0, time.Date(2024, 3, 30, 0, 0, 0, 0, time.Local), []string{"bar-2.0-r0.apk", "foo-1.10-r0.apk", "foo-1.9-r0.apk", "foo-1.2-r0.apk"}},
+	}
+	for _, test := range tests {
+		remove, err := plan_prune(files, test.keep, test.newer_than)
+		if (err != nil) {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		names := []string{}
+		for _, file := range remove {
+			names = append(names, file.Name)
+		}
+		if (reflect.DeepEqual(names, test.want) == false) {
+			t.Errorf("%s: got %q, want %q", test.name, names, test.want)
+		}
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Options for the reproduce command.
+var (
+	reproduce_twice bool
+	source_date_epoch string
+)
+
+// Line diffs are skipped for files where the product of line counts is
+// larger than this, and are cut off after this many lines.
+const (
+	diff_max_cells = 4000000
+	diff_max_lines = 40
+)
+
+// Reproducibility stores the latest result of checking whether a Package is
+// reproducible.
+type Reproducibility struct {
+	Version      string    `json:"version"`
+	Reproducible bool      `json:"reproducible"`
+	Compared     string    `json:"compared"`
+	Epoch        int64     `json:"source_date_epoch"`
+	Differences  int       `json:"differences"`
+	Digest       string    `json:"digest,omitempty"`
+	Checked      time.Time `json:"checked"`
+}
+
+// Difference stores a file that differs between two apks.
+type Difference struct {
+	Name    string
+	Problem string
+	Diff    []string
+}
+
+// Construct the filename that results are recorded in. There is a single file
+// for all targets.
+func reproducibility_filename(state_dir string) string {
+	return path.Join(state_dir, "reproducible.json")
+}
+
+// Construct the key that the result for a Package is recorded under. The same
+// package can be in several targets.
+func reproducibility_key(target, name string) string {
+	return target + "/" + name
+}
+
+// Load recorded results, keyed by target and package name (see
+// reproducibility_key).
+func load_reproducibility(filename string) (map[string]Reproducibility, error) {
+	records := map[string]Reproducibility{}
+
+	content, err := os.ReadFile(filename)
+	if (errors.Is(err, fs.ErrNotExist) == true) {
+		return records, nil
+	} else if (err != nil) {
+		return records, err
+	}
+
+	err = json.Unmarshal(content, &records)
+	if (err != nil) {
+		return records, fmt.Errorf("Cannot parse %s: %s", filename, err)
+	}
+	return records, nil
+}
+
+// Save recorded results. The file is replaced atomically.
+func save_reproducibility(filename string, records map[string]Reproducibility) error {
+	content, err := json.MarshalIndent(records, "", "  ")
+	if (err != nil) {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(filename), 0755)
+	if (err != nil) {
+		return err
+	}
+
+	err = os.WriteFile(filename + ".tmp", content, 0644)
+	if (err != nil) {
+		return err
+	}
+
+	return os.Rename(filename + ".tmp", filename)
+}
+
+// Find the SOURCE_DATE_EPOCH to build a Package with, when it is not compared
+// to the repository: the time of the last commit to the package source, or
+// else the modification time of the APKBUILD.
+func package_epoch(pkg Package) (int64, error) {
+	out, err := run_git(pkg.Path, "log", "-1", "--format=%ct", "--", ".")
+	if (err == nil) && (strings.TrimSpace(out) != "") {
+		return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	}
+
+	info, err := os.Stat(path.Join(pkg.Path, "APKBUILD"))
+	if (err != nil) {
+		return 0, err
+	}
+	return info.ModTime().Unix(), nil
+}
+
+// Pull the repository of a target into a temporary directory, unless it was
+// already pulled during this run. Returns the directory that packages were
+// pulled into, which is removed by the caller.
+func pull_target(pulled map[string]string, pkg Package, arch string) (string, error) {
+	target := target_name(pkg.Repository, arch)
+	dir, ok := pulled[target]
+	if (ok == true) {
+		return dir, nil
+	}
+
+	dir, err := os.MkdirTemp("", "simple-builder-pull-")
+	if (err != nil) {
+		return "", err
+	}
+
+	logger("reproduce").Info("Pulling", "repository", pkg.Repository)
+	err = pull_repository(pkg.Repository, dir, sync_mode)
+	if (err != nil) {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	pulled[target] = dir
+	return dir, nil
+}
+
+// Copy the regular files of a directory into another directory, recursively.
+func copy_directory(src, dst string) error {
+	return filepath.WalkDir(src, func(name string, entry fs.DirEntry, err error) error {
+		if (err != nil) {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, name)
+		if (err != nil) {
+			return err
+		}
+		target := path.Join(dst, rel)
+
+		if (entry.IsDir() == true) {
+			return os.MkdirAll(target, 0755)
+		} else if (entry.Type().IsRegular() == false) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if (err != nil) {
+			return err
+		}
+
+		in, err := os.Open(name)
+		if (err != nil) {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(target, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, info.Mode().Perm())
+		if (err != nil) {
+			return err
+		}
+
+		_, err = io.Copy(out, in)
+		if (err != nil) {
+			out.Close()
+			return err
+		}
+		err = out.Close()
+		if (err != nil) {
+			return err
+		}
+
+		// Timestamps are kept, like rsync --times would.
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+}
+
+// Build a Package in a fresh container, into a temporary directory that a
+// copy of the pulled repository is placed in. Returns the apk filename and the
+// temporary directory, which should be removed by the caller, and the digest
+// of the image used.
+func reproduce_build(pkg Package, arch string, opts BuildOptions, pulled_dir, log_file string) (string, string, string, error) {
+	tmp, err := os.MkdirTemp("", "simple-builder-reproduce-")
+	if (err != nil) {
+		return "", "", "", err
+	}
+
+	pkgdir := package_destination(tmp, pkg)
+	local_dir := expected_apkdir(pkgdir, arch)
+	err = copy_directory(pulled_dir, local_dir)
+	if (err != nil) {
+		return "", tmp, "", err
+	}
+
+	// A pulled copy of the package must not be mistaken for the build.
+	filename := path.Join(local_dir, expected_apk(pkg))
+	err = os.Remove(filename)
+	if (err != nil) && (errors.Is(err, fs.ErrNotExist) == false) {
+		return "", tmp, "", err
+	}
+
+	_, digest, err := build_package(pkg, pkgdir, arch, opts, log_file)
+	if (err != nil) {
+		return "", tmp, "", err
+	}
+
+	return filename, tmp, digest, nil
+}
+
+// Check whether a Package is reproducible. If the repository has the same
+// version, the Package is rebuilt once and compared to it, using the build date
+// of that package as SOURCE_DATE_EPOCH. Otherwise (or with -twice) it is built
+// twice. An epoch of -1 means to find one. Builds start from a copy of the
+// repository pulled into pulled_dir.
+func reproduce_package(pkg Package, arch string, opts BuildOptions, state_dir, pulled_dir string, in_repository bool, epoch int64) (Reproducibility, []Difference, error) {
+	result := Reproducibility{Version: pkg.Version, Checked: time.Now()}
+	target := target_name(pkg.Repository, arch)
+	files := []string{}
+	labels := []string{}
+
+	if (in_repository == true) {
+		tmp, err := os.MkdirTemp("", "simple-builder-reproduce-")
+		if (err != nil) {
+			return result, nil, err
+		}
+		defer os.RemoveAll(tmp)
+
+		logger("reproduce").Info("Fetching", "package", pkg.Name, "repository", pkg.Repository)
+		err = fetch_file(pkg.Repository, expected_apk(pkg), tmp)
+		if (err != nil) {
+			return result, nil, fmt.Errorf("Cannot fetch %s from %s: %s", expected_apk(pkg), pkg.Repository, err)
+		}
+		files = append(files, path.Join(tmp, expected_apk(pkg)))
+		labels = append(labels, "repository")
+		result.Compared = "repository"
+
+		if (epoch == -1) {
+			artifact, err := read_artifact(files[0])
+			if (err != nil) {
+				return result, nil, err
+			}
+			epoch, err = strconv.ParseInt(artifact.get("builddate"), 10, 64)
+			if (err != nil) {
+				return result, nil, fmt.Errorf("%s has no valid builddate", expected_apk(pkg))
+			}
+		}
+	} else {
+		result.Compared = "rebuild"
+	}
+
+	if (epoch == -1) {
+		found, err := package_epoch(pkg)
+		if (err != nil) {
+			return result, nil, err
+		}
+		epoch = found
+	}
+	result.Epoch = epoch
+
+	opts.Environment = append(append([]string{}, opts.Environment...), fmt.Sprintf("SOURCE_DATE_EPOCH=%d", epoch))
+
+	if (opts.Distfiles != "") {
+		err := fetch_distfiles(pkg, opts.Distfiles)
+		if (err != nil) {
+			return result, nil, err
+		}
+	}
+
+	for build := 1; len(files) < 2; build++ {
+		log_file := strings.TrimSuffix(log_filename(state_dir, target, pkg), ".log") + fmt.Sprintf("-reproduce-%d.log", build)
+
+		logger("reproduce").Info("Building", "package", pkg.Name, "version", pkg.Version, "source_date_epoch", epoch)
+		filename, tmp, digest, err := reproduce_build(pkg, arch, opts, pulled_dir, log_file)
+		if (tmp != "") {
+			defer os.RemoveAll(tmp)
+		}
+		if (err != nil) {
+			return result, nil, err
+		}
+
+		// Later builds use the same image, even if the tag moves.
+		if (digest != "") && (result.Digest == "") {
+			result.Digest = digest
+			opts.Image.Pins = map[string]string{target: digest}
+		}
+		files = append(files, filename)
+		labels = append(labels, fmt.Sprintf("build %d", build))
+	}
+
+	differences, err := compare_apks(files[0], files[1], labels[0], labels[1])
+	if (err != nil) {
+		return result, nil, err
+	}
+
+	result.Reproducible = (len(differences) == 0)
+	result.Differences = len(differences)
+	return result, differences, nil
+}
+
+// Read the files of an apk, keyed by name. The control files (like
+// `.PKGINFO`) are included, but not the signature.
+func read_apk_files(filename string) (map[string]IndexMember, error) {
+	members, err := read_archive_members(filename)
+	if (err != nil) {
+		return nil, err
+	}
+
+	files := map[string]IndexMember{}
+	for _, member := range members {
+		files[member.Header.Name] = member
+	}
+	return files, nil
+}
+
+// Compare the contents of two apks file by file.
+func compare_apks(a_name, b_name, a_label, b_label string) ([]Difference, error) {
+	a, err := read_apk_files(a_name)
+	if (err != nil) {
+		return nil, err
+	}
+	b, err := read_apk_files(b_name)
+	if (err != nil) {
+		return nil, err
+	}
+
+	names := sorted_keys(a)
+	for name, _ := range b {
+		_, ok := a[name]
+		if (ok == false) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	differences := []Difference{}
+	for _, name := range names {
+		a_file, in_a := a[name]
+		b_file, in_b := b[name]
+
+		if (in_b == false) {
+			differences = append(differences, Difference{name, "only in " + a_label, nil})
+		} else if (in_a == false) {
+			differences = append(differences, Difference{name, "only in " + b_label, nil})
+		} else {
+			differences = append(differences, compare_files(a_file, b_file, a_label, b_label)...)
+		}
+	}
+
+	return differences, nil
+}
+
+// Compare a file from two apks. Metadata is compared first, then content.
+func compare_files(a, b IndexMember, a_label, b_label string) []Difference {
+	name := a.Header.Name
+	differences := []Difference{}
+
+	add := func(problem string, a_value, b_value any) {
+		problem = fmt.Sprintf("%s %v (%s) vs %v (%s)", problem, a_value, a_label, b_value, b_label)
+		differences = append(differences, Difference{name, problem, nil})
+	}
+
+	if (a.Header.Typeflag != b.Header.Typeflag) {
+		add("type", string(a.Header.Typeflag), string(b.Header.Typeflag))
+	}
+	if (a.Header.Mode != b.Header.Mode) {
+		add("mode", fmt.Sprintf("%04o", a.Header.Mode), fmt.Sprintf("%04o", b.Header.Mode))
+	}
+	if (a.Header.Uid != b.Header.Uid) || (a.Header.Gid != b.Header.Gid) {
+		add("owner", fmt.Sprintf("%d:%d", a.Header.Uid, a.Header.Gid), fmt.Sprintf("%d:%d", b.Header.Uid, b.Header.Gid))
+	}
+	if (a.Header.ModTime.Equal(b.Header.ModTime) == false) {
+		add("modified", a.Header.ModTime.UTC().Format(time.RFC3339), b.Header.ModTime.UTC().Format(time.RFC3339))
+	}
+	if (a.Header.Linkname != b.Header.Linkname) {
+		add("link", a.Header.Linkname, b.Header.Linkname)
+	}
+
+	// Extended attributes can be set in either file.
+	keys := sorted_keys(a.Header.PAXRecords)
+	for key, _ := range b.Header.PAXRecords {
+		_, ok := a.Header.PAXRecords[key]
+		if (ok == false) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if (strings.HasPrefix(key, "SCHILY.xattr.") == false) {
+			continue
+		}
+		a_value, in_a := a.Header.PAXRecords[key]
+		b_value, in_b := b.Header.PAXRecords[key]
+		if (in_a == false) {
+			a_value = "(none)"
+		}
+		if (in_b == false) {
+			b_value = "(none)"
+		}
+		if (in_a != in_b) || (a_value != b_value) {
+			add("attribute " + strings.TrimPrefix(key, "SCHILY.xattr."), a_value, b_value)
+		}
+	}
+
+	if (bytes.Equal(a.Data, b.Data) == true) {
+		return differences
+	}
+
+	if (is_text(a.Data) == true) && (is_text(b.Data) == true) {
+		diff := diff_lines(string(a.Data), string(b.Data))
+		if (diff != nil) {
+			differences = append(differences, Difference{name, "content differs", diff})
+			return differences
+		}
+	}
+
+	add("content", short_digest(a.Data), short_digest(b.Data))
+	return differences
+}
+
+// Check if content is text that can be diffed.
+func is_text(content []byte) bool {
+	return (utf8.Valid(content) == true) && (bytes.IndexByte(content, 0) == -1)
+}
+
+// Construct a short SHA256 digest of content, with its size.
+func short_digest(content []byte) string {
+	digest := sha256.Sum256(content)
+	return fmt.Sprintf("sha256:%s, %d bytes", hex.EncodeToString(digest[:])[:12], len(content))
+}
+
+// Diff two texts line by line. Removed lines are prefixed with `-` and added
+// lines with `+`. Returns nil if the texts are too large to diff.
+func diff_lines(a, b string) []string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	n := len(x)
+	m := len(y)
+	if (n * m > diff_max_cells) {
+		return nil
+	}
+
+	// Length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, n + 1)
+	for i, _ := range lcs {
+		lcs[i] = make([]int, m + 1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if (x[i] == y[j]) {
+				lcs[i][j] = lcs[i + 1][j + 1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i + 1][j], lcs[i][j + 1])
+			}
+		}
+	}
+
+	diff := []string{}
+	i, j := 0, 0
+	for (i < n) || (j < m) {
+		if (i < n) && (j < m) && (x[i] == y[j]) {
+			i++
+			j++
+		} else if (i < n) && ((j == m) || (lcs[i + 1][j] >= lcs[i][j + 1])) {
+			diff = append(diff, "-" + x[i])
+			i++
+		} else {
+			diff = append(diff, "+" + y[j])
+			j++
+		}
+	}
+
+	if (len(diff) > diff_max_lines) {
+		more := len(diff) - diff_max_lines
+		diff = append(diff[:diff_max_lines], fmt.Sprintf("... %d more lines", more))
+	}
+	return diff
+}
+
+// Print the result of checking a Package.
+func report_reproducibility(pkg Package, result Reproducibility, differences []Difference) {
+	against := "between two builds"
+	if (result.Compared == "repository") {
+		against = "against the repository"
+	}
+
+	if (result.Reproducible == true) {
+		fmt.Printf("%s %s - reproducible (%s, SOURCE_DATE_EPOCH=%d)\n", pkg.Name, pkg.Version, against, result.Epoch)
+		return
+	}
+
+	fmt.Printf("%s %s - not reproducible (%s, SOURCE_DATE_EPOCH=%d)\n", pkg.Name, pkg.Version, against, result.Epoch)
+	for _, difference := range differences {
+		fmt.Printf("  %s: %s\n", difference.Name, difference.Problem)
+		for _, line := range difference.Diff {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+}
+
+// Check whether packages are reproducible, and record the results. This is
+// the `reproduce` command.
+func run_reproduce(args []string) error {
+	src := clean_source(source)
+	repo := clean_repository(repository)
+	arch := clean_architecture(architecture, repo)
+	state := clean_state(state_dir)
+	sync_mode = clean_sync(sync_mode)
+	opts := clean_build_options(local_repository, container_repositories, public_key, distfiles, clean_image_options(image_name, pull_policy, pin_image, arch), cross)
+	epoch := clean_epoch(source_date_epoch)
+
+	// Every selected package is checked, not only those with updates.
+	sel := new_selection(append(clean_patterns(only), args...), clean_patterns(exclude), false, false, true)
+	packages, err := compare_lists(src, depth, repo, clean_sections(sections), sel)
+	if (err != nil) {
+		return err
+	}
+
+	filename := reproducibility_filename(state)
+	records, err := load_reproducibility(filename)
+	if (err != nil) {
+		return err
+	}
+
+	if (len(packages) != 0) {
+		opts.Host, err = check_platform(arch, packages[0].Repository, opts)
+		if (err != nil) {
+			return err
+		}
+	}
+
+	repositories := map[string][]Package{}
+	pulled := map[string]string{}
+	defer func() {
+		for _, dir := range pulled {
+			os.RemoveAll(dir)
+		}
+	}()
+	failed := 0
+	unreproducible := 0
+
+	for _, pkg := range packages {
+		in_repository := false
+		if (reproduce_twice == false) {
+			listing, ok := repositories[pkg.Repository]
+			if (ok == false) {
+				listing, err = fetch_repository_packages(pkg.Repository)
+				if (err != nil) {
+					return err
+				}
+				repositories[pkg.Repository] = listing
+			}
+			for _, p := range listing {
+				if (p.Name == pkg.Name) && (p.Version == pkg.Version) {
+					in_repository = true
+				}
+			}
+		}
+
+		var result Reproducibility
+		var differences []Difference
+
+		pulled_dir, err := pull_target(pulled, pkg, arch)
+		if (err == nil) {
+			result, differences, err = reproduce_package(pkg, arch, opts, state, pulled_dir, in_repository, epoch)
+		}
+		if (err != nil) {
+			fmt.Printf("%s %s - failed: %s\n", pkg.Name, pkg.Version, err)
+			failed++
+			continue
+		}
+
+		report_reproducibility(pkg, result, differences)
+		if (result.Reproducible == false) {
+			unreproducible++
+		}
+
+		records[reproducibility_key(target_name(pkg.Repository, arch), pkg.Name)] = result
+		err = save_reproducibility(filename, records)
+		if (err != nil) {
+			return err
+		}
+	}
+
+	if (unreproducible != 0) && (failed != 0) {
+		return fmt.Errorf("%d packages are not reproducible, and %d could not be checked", unreproducible, failed)
+	} else if (unreproducible != 0) {
+		return fmt.Errorf("%d packages are not reproducible", unreproducible)
+	} else if (failed != 0) {
+		return fmt.Errorf("%d packages could not be checked", failed)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCopyDirectory(t *testing.T) {
+	src := t.TempDir()
+	dst := path.Join(t.TempDir(), "x86_64")
+	modified := time.Date(2024, 3, 2, 14, 3, 11, 0, time.UTC)
+
+	files := map[string]string{
+		"APKINDEX.tar.gz": "index",
+		"foo-1.0-r0.apk": "foo",
+		"community/bar-2.0-r1.apk": "bar",
+	}
+	for name, content := range files {
+		filename := path.Join(src, name)
+		err := os.MkdirAll(path.Dir(filename), 0755)
+		if (err != nil) {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filename, []byte(content), 0644)
+		if (err != nil) {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(filename, modified, modified)
+		if (err != nil) {
+			t.Fatal(err)
+		}
+	}
+
+	err := copy_directory(src, dst)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		filename := path.Join(dst, name)
+		content, err := os.ReadFile(filename)
+		if (err != nil) {
+			t.Errorf("%s: %s", name, err)
+			continue
+		} else if (string(content) != want) {
+			t.Errorf("%s: got %q, want %q", name, content, want)
+		}
+
+		info, err := os.Stat(filename)
+		if (err != nil) {
+			t.Fatal(err)
+		} else if (info.ModTime().Equal(modified) == false) {
+			t.Errorf("%s: modified %s, want %s", name, info.ModTime(), modified)
+		}
+	}
+
+	// Builds change their copy, not the pulled repository.
+	err = os.Remove(path.Join(dst, "foo-1.0-r0.apk"))
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(path.Join(src, "foo-1.0-r0.apk"))
+	if (err != nil) {
+		t.Errorf("removing a copied file removed the original: %s", err)
+	}
+}
+
+func TestCompareFilesAttributes(t *testing.T) {
+	tests := []struct {
+		name string
+		a    map[string]string
+		b    map[string]string
+		want []string
+	}{
+		{
+			"same",
+			map[string]string{"SCHILY.xattr.security.capability": "cap"},
+			map[string]string{"SCHILY.xattr.security.capability": "cap"},
+			[]string{},
+		},
+		{
+			"only in b",
+			nil,
+			map[string]string{"SCHILY.xattr.security.capability": "cap"},
+			[]string{"attribute security.capability (none) (repository) vs cap (build 1)"},
+		},
+		{
+			"only in a",
+			map[string]string{"SCHILY.xattr.user.foo": "x", "path": "ignored"},
+			map[string]string{},
+			[]string{"attribute user.foo x (repository) vs (none) (build 1)"},
+		},
+		{
+			"changed",
+			map[string]string{"SCHILY.xattr.user.a": "1", "SCHILY.xattr.user.b": "2"},
+			map[string]string{"SCHILY.xattr.user.b": "3", "SCHILY.xattr.user.a": "1"},
+			[]string{"attribute user.b 2 (repository) vs 3 (build 1)"},
+		},
+	}
+
+	for _, test := range tests {
+		modified := time.Unix(1709388191, 0)
+		a := IndexMember{&tar.Header{Name: "usr/bin/foo", Mode: 0755, ModTime: modified, PAXRecords: test.a}, []byte("foo")}
+		b := IndexMember{&tar.Header{Name: "usr/bin/foo", Mode: 0755, ModTime: modified, PAXRecords: test.b}, []byte("foo")}
+
+		got := []string{}
+		for _, difference := range compare_files(a, b, "repository", "build 1") {
+			got = append(got, difference.Problem)
+		}
+		if (reflect.DeepEqual(got, test.want) == false) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -72,8 +73,9 @@ func resolve_dependencies(resolved, pkgs *[]Package, index int, visited *[]strin
 	return nil
 }
 
-// Find packages to build.
-func find_builds(pkg *Package, repository *[]Package) error {
+// Find packages to build. If a rebuild is forced and the version is the same
+// as in the repository, optionally bump the release.
+func find_builds(pkg *Package, repository *[]Package, bump bool) error {
 	i := find_package(repository, (*pkg).Name)
 
 	// Package is new.
@@ -96,8 +98,25 @@ func find_builds(pkg *Package, repository *[]Package) error {
 		return nil
 	}
 
-	// Package already exists, nothing to do.
+	// Package already exists, nothing to do unless a rebuild is forced.
 	if (diff == 0) {
+		if ((*pkg).Forced == false) {
+			return nil
+		}
+
+		(*pkg).Build = true
+		(*pkg).Message = "forced rebuild"
+
+		if (bump == true) {
+			version, err := bump_version((*pkg).Version)
+			if (err != nil) {
+				return err
+			}
+			(*pkg).Version = version
+			(*pkg).Bumped = true
+			(*pkg).Message = fmt.Sprintf("forced rebuild, bump to %s", version)
+		}
+
 		return nil
 	}
 
@@ -165,11 +184,26 @@ func parse_version_string(version string) ([5]int, error) {
 	}
 	ver[4] = release
 
-	debug(fmt.Sprintf("DEBUG-RESOLVER:%s -> %s", version, ver))
+	logger("resolver").Debug("Parsed version", "version", version, "parsed", ver)
 
 	return ver, nil
 }
 
+// Increment the release of a version string.
+func bump_version(version string) (string, error) {
+	parts := strings.SplitN(version, "-r", 2)
+	if (len(parts) != 2) {
+		return "", fmt.Errorf("cannot parse %s", version)
+	}
+
+	release, err := strconv.Atoi(parts[1])
+	if (err != nil) {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s-r%d", parts[0], release + 1), nil
+}
+
 // Compare two version strings.
 func compare_versions(remote, local string) (int, error) {
 	remote_ver, err := parse_version_string(remote)
@@ -3,44 +3,35 @@ package main
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"path"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
-	pattern_rsync_stdout = regexp.MustCompile(`^[drwx-]{10} *[0-9,]+ *[0-9]{4}/[0-9]{2}/[0-9]{2} *[0-9]{2}:[0-9]{2}:[0-9]{2} ([A-Za-z0-9._-]+) *$`)
+	pattern_rsync_stdout = regexp.MustCompile(`^[drwx-]{10} *([0-9,]+) *([0-9]{4}/[0-9]{2}/[0-9]{2} *[0-9]{2}:[0-9]{2}:[0-9]{2}) ([A-Za-z0-9._-]+) *$`)
 )
 
+// RemoteFile stores the details of a file in a remote directory.
+type RemoteFile struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
 // Fetch a listing from a directory that is serving as a package repository.
+// If there are multiple versions of a package, only the newest is kept.
 func fetch_repository_listing(remote_dir string) ([]Package, error) {
-	debug(fmt.Sprintf("DEBUG-RSYNC:rsync --list-only %s", remote_dir))
-	cmd := exec.Command("rsync", "--list-only", remote_dir)
-	stdout, err := cmd.StdoutPipe()
-	if (err != nil) {
-		return nil, err
-	}
-	err = cmd.Start()
-	if (err != nil) {
-		return nil, err
-	}
-
-	pkgs, err := parse_rsync_stdout(stdout)
+	pkgs, err := fetch_repository_packages(remote_dir)
 	if (err != nil) {
 		return nil, err
 	}
 
-	err = cmd.Wait()
-	if (err != nil) {
-		return nil, err
-	}
-
-	if (len(pkgs) == 0) {
-		return nil, errors.New("No packages found")
-	}
-
 	uniq := []Package{}
 	for _, pkg := range pkgs {
 		i := find_package(&uniq, pkg.Name)
@@ -60,20 +51,75 @@ func fetch_repository_listing(remote_dir string) ([]Package, error) {
 	return uniq, nil
 }
 
+// Fetch a listing of every package in a repository, including multiple
+// versions of the same package.
+func fetch_repository_packages(remote_dir string) ([]Package, error) {
+	files, err := fetch_remote_files(remote_dir)
+	if (err != nil) {
+		return nil, err
+	}
+
+	pkgs := []Package{}
+	for _, file := range files {
+		// Not an error, but also not a package.
+		if (file.Name == ".") || (file.Name == "APKINDEX.tar.gz") {
+			continue
+		}
+
+		pkg, err := find_apk(file.Name)
+		if (err != nil) {
+			return nil, err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+
+	if (len(pkgs) == 0) {
+		return nil, errors.New("No packages found")
+	}
+
+	return pkgs, nil
+}
+
+// Fetch a listing of the files in a remote directory.
+func fetch_remote_files(remote_dir string) ([]RemoteFile, error) {
+	logger("rsync").Debug("Listing", "repository", remote_dir)
+	cmd := exec.Command("rsync", "--list-only", remote_dir)
+	stdout, err := cmd.StdoutPipe()
+	if (err != nil) {
+		return nil, err
+	}
+	err = cmd.Start()
+	if (err != nil) {
+		return nil, err
+	}
+
+	files, err := parse_rsync_stdout(stdout)
+	if (err != nil) {
+		return nil, err
+	}
+
+	err = cmd.Wait()
+	if (err != nil) {
+		return nil, err
+	}
+
+	return files, nil
+}
+
 // Parse `rsync(1)` output.
-func parse_rsync_stdout(stdout io.Reader) ([]Package, error) {
-	packages := []Package{}
+func parse_rsync_stdout(stdout io.Reader) ([]RemoteFile, error) {
+	files := []RemoteFile{}
 
 	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
 		line := scanner.Text()
 
-		pkgs, err := parse_rsync_line(line)
+		file, err := parse_rsync_line(line)
 		if (err != nil) {
 			return nil, err
 		}
 
-		packages = append(packages, pkgs...)
+		files = append(files, file)
 	}
 
 	err := scanner.Err()
@@ -81,54 +127,114 @@ func parse_rsync_stdout(stdout io.Reader) ([]Package, error) {
 		return nil, err
 	}
 
-	return packages, nil
+	return files, nil
 }
 
-// Parse a line of `rsync(1)` output into 0 or 1 packages.
-func parse_rsync_line(line string) ([]Package, error) {
-	debug(fmt.Sprintf("DEBUG-RSYNC:%s", line))
+// Parse a line of `rsync(1)` output into a RemoteFile.
+func parse_rsync_line(line string) (RemoteFile, error) {
+	logger("rsync").Debug("Listed", "line", line)
 
 	match := pattern_rsync_stdout.FindStringSubmatch(line)
-	if (match != nil) {
-		name := match[1]
+	if (match == nil) {
+		return RemoteFile{}, errors.New("Failed to parse line of rsync stdout")
+	}
 
-		// Return an empty slice. Not an error, but also not a package.
-		if (name == ".") || (name == "APKINDEX.tar.gz") {
-			return []Package{}, nil
-		}
+	size, err := strconv.ParseInt(strings.ReplaceAll(match[1], ",", ""), 10, 64)
+	if (err != nil) {
+		return RemoteFile{}, err
+	}
 
-		// Repackage return value into slice.
-		pkg, err := find_apk(name)
-		if (err != nil) {
-			return nil, err
-		} else {
-			return []Package{pkg}, nil
-		}
+	modified, err := time.ParseInLocation("2006/01/02 15:04:05", strings.Join(strings.Fields(match[2]), " "), time.Local)
+	if (err != nil) {
+		return RemoteFile{}, err
 	}
 
-	return nil, errors.New("Failed to parse line of rsync stdout")
+	return RemoteFile{match[3], size, modified}, nil
 }
 
-// Push a built package and an updated APKINDEX to a package repository.
-func push_package(pkg Package, local_dir, remote_dir string) error {
-	local_name := path.Join(local_dir, expected_apk(pkg))
+// Fetch a file from a remote directory into a local directory.
+func fetch_file(remote_dir, name, local_dir string) error {
+	remote_name := remote_dir + name
 
-	debug(fmt.Sprintf("DEBUG-RSYNC:rsync %s %s", local_name, remote_dir))
-	cmd := exec.Command("rsync", local_name, remote_dir)
-	err := cmd.Run()
+	logger("rsync").Debug("Fetching", "file", remote_name, "destination", local_dir)
+	cmd := exec.Command("rsync", remote_name, local_dir + "/")
+	return cmd.Run()
+}
+
+// Pull a package repository into a local directory, so that builds (and the
+// APKINDEX they regenerate) start from the state of the repository. With the
+// `index` mode, only the APKINDEX is pulled. Transfers are incremental, and
+// packages that were deleted from the repository are deleted locally.
+func pull_repository(remote_dir, local_dir, mode string) error {
+	if (mode == "none") {
+		return nil
+	}
+
+	err := os.MkdirAll(local_dir, 0755)
 	if (err != nil) {
 		return err
 	}
 
-	local_name = path.Join(local_dir, "APKINDEX.tar.gz")
+	args := pull_arguments(remote_dir, local_dir, mode)
+	logger("rsync").Debug("Running rsync", "args", args)
+	cmd := exec.Command("rsync", args...)
+	return cmd.Run()
+}
+
+// Construct the `rsync(1)` arguments for pulling a package repository.
+func pull_arguments(remote_dir, local_dir, mode string) []string {
+	if (mode == "index") {
+		return []string{remote_dir + "APKINDEX.tar.gz", local_dir + "/"}
+	}
+	return []string{"--recursive", "--times", "--delete", "--include=*.apk", "--include=APKINDEX.tar.gz", "--exclude=*", remote_dir, local_dir + "/"}
+}
+
+// Push a built package and an updated APKINDEX to a package repository.
+func push_package(pkg Package, local_dir, remote_dir string) error {
+	started := time.Now()
+
+	var err error
+	for _, local_name := range push_filenames(pkg, local_dir) {
+		err = push_file(local_name, remote_dir)
+		if (err != nil) {
+			break
+		}
+	}
+
+	builder_metrics.observe_push(remote_dir, time.Since(started), err)
+	return err
+}
+
+// Construct the local filenames that are pushed for a Package, in order. The
+// APKINDEX is pushed last, so that it never lists a missing package.
+func push_filenames(pkg Package, local_dir string) []string {
+	return []string{path.Join(local_dir, expected_apk(pkg)), path.Join(local_dir, "APKINDEX.tar.gz")}
+}
+
+// Push a local file to a remote directory.
+func push_file(local_name, remote_dir string) error {
+	logger("rsync").Debug("Pushing", "file", local_name, "repository", remote_dir)
+	cmd := exec.Command("rsync", local_name, remote_dir)
+	return cmd.Run()
+}
 
-	debug(fmt.Sprintf("DEBUG-RSYNC:rsync %s %s", local_name, remote_dir))
-	cmd = exec.Command("rsync", local_name, remote_dir)
-	err = cmd.Run()
+// Delete files from a remote directory. `rsync(1)` cannot delete a remote file
+// directly, so an empty directory is synchronized to the remote directory with
+// only those files included.
+func delete_files(remote_dir string, names []string) error {
+	empty, err := os.MkdirTemp("", "simple-builder-")
 	if (err != nil) {
 		return err
 	}
+	defer os.RemoveAll(empty)
 
-	return nil
-}
+	args := []string{"--recursive", "--delete"}
+	for _, name := range names {
+		args = append(args, "--include=/" + name)
+	}
+	args = append(args, "--exclude=*", empty + "/", remote_dir)
 
+	logger("rsync").Debug("Running rsync", "args", args)
+	cmd := exec.Command("rsync", args...)
+	return cmd.Run()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestPullArguments(t *testing.T) {
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{"all", []string{"--recursive", "--times", "--delete", "--include=*.apk", "--include=APKINDEX.tar.gz", "--exclude=*", "host:/srv/x86_64/", "pkg/x86_64/"}},
+		{"index", []string{"host:/srv/x86_64/APKINDEX.tar.gz", "pkg/x86_64/"}},
+	}
+	for _, test := range tests {
+		got := pull_arguments("host:/srv/x86_64/", "pkg/x86_64", test.mode)
+		if (reflect.DeepEqual(got, test.want) == false) {
+			t.Errorf("%s: got %q, want %q", test.mode, got, test.want)
+		}
+	}
+}
+
+func TestPullRepositoryNone(t *testing.T) {
+	local_dir := path.Join(t.TempDir(), "x86_64")
+
+	// Nothing is run, so the remote does not need to exist.
+	err := pull_repository("host:/srv/x86_64/", local_dir, "none")
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(local_dir)
+	if (os.IsNotExist(err) == false) {
+		t.Errorf("created %s without pulling", local_dir)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// Selection stores the criteria for restricting a run to some Packages.
+type Selection struct {
+	Only      []string
+	Exclude   []string
+	WithDeps  bool
+	WithRdeps bool
+	Force     bool
+}
+
+func new_selection(only, exclude []string, with_deps, with_rdeps, force bool) Selection {
+	return Selection{only, exclude, with_deps, with_rdeps, force}
+}
+
+// Check if any criteria were given.
+func (sel Selection) is_empty() bool {
+	return (len(sel.Only) == 0) && (len(sel.Exclude) == 0)
+}
+
+// Check if a Package name matches the criteria. Dependencies are not
+// considered.
+func (sel Selection) matches(name string) bool {
+	if (match_any(sel.Exclude, name) == true) {
+		return false
+	}
+	if (len(sel.Only) == 0) {
+		return true
+	}
+	return match_any(sel.Only, name)
+}
+
+// Check if a name matches any of a list of glob patterns.
+func match_any(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		ok, err := path.Match(pattern, name)
+		if (err == nil) && (ok == true) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that every pattern in -only (or a positional argument) matches at
+// least one package source. A pattern that matches nothing is most likely a
+// typo.
+func check_selection(sel Selection, package_sources []Package) error {
+	for _, pattern := range sel.Only {
+		_, err := path.Match(pattern, "")
+		if (err != nil) {
+			return fmt.Errorf("Pattern %s is invalid: %s", pattern, err)
+		}
+
+		found := false
+		for _, pkg := range package_sources {
+			if (match_any([]string{pattern}, pkg.Name) == true) {
+				found = true
+				break
+			}
+		}
+		if (found == false) {
+			return fmt.Errorf("No package source matches %s", pattern)
+		}
+	}
+
+	for _, pattern := range sel.Exclude {
+		_, err := path.Match(pattern, "")
+		if (err != nil) {
+			return fmt.Errorf("Pattern %s is invalid: %s", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// Restrict the queue to the selected Packages. Out-of-date dependencies and
+// reverse dependencies are pulled in as requested. If a selected Package
+// depends on an out-of-date Package that was not selected, building it would
+// use a stale dependency, so this is an error.
+func select_packages(queue []Package, sel Selection) ([]Package, error) {
+	if (sel.is_empty() == true) {
+		return queue, nil
+	}
+
+	selected := []Package{}
+	for _, pkg := range queue {
+		if (sel.matches(pkg.Name) == true) {
+			selected = append(selected, pkg)
+		}
+	}
+
+	if (sel.WithDeps == true) {
+		for i := 0; i < len(selected); i++ {
+			for _, dep := range selected[i].Dependencies {
+				if (find_package(&selected, dep) != -1) || (match_any(sel.Exclude, dep) == true) {
+					continue
+				}
+
+				j := find_package(&queue, dep)
+				if (j != -1) {
+					logger("resolver").Debug("Pulled in", "package", dep, "by", selected[i].Name)
+					selected = append(selected, queue[j])
+				}
+			}
+		}
+	}
+
+	if (sel.WithRdeps == true) {
+		for changed := true; changed == true; {
+			changed = false
+			for _, pkg := range queue {
+				if (find_package(&selected, pkg.Name) != -1) || (match_any(sel.Exclude, pkg.Name) == true) {
+					continue
+				}
+
+				for _, dep := range pkg.Dependencies {
+					if (find_package(&selected, dep) != -1) {
+						logger("resolver").Debug("Pulled in", "package", pkg.Name, "by", dep)
+						selected = append(selected, pkg)
+						changed = true
+						break
+					}
+				}
+			}
+		}
+	}
+
+	for _, pkg := range selected {
+		for _, dep := range pkg.Dependencies {
+			if (find_package(&queue, dep) != -1) && (find_package(&selected, dep) == -1) {
+				return nil, fmt.Errorf("Package %s depends on updated/new %s but it is not selected (try -with-deps)", pkg.Name, dep)
+			}
+		}
+	}
+
+	return selected, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A queue of out-of-date Packages. foo depends on bar, which depends on baz.
+// qux depends on foo.
+func test_queue() []Package {
+	foo := new_package_with_version("foo", "1.0-r0")
+	foo.Dependencies = []string{"bar", "musl"}
+	bar := new_package_with_version("bar", "2.0-r0")
+	bar.Dependencies = []string{"baz"}
+	baz := new_package_with_version("baz", "3.0-r0")
+	qux := new_package_with_version("qux", "4.0-r0")
+	qux.Dependencies = []string{"foo"}
+	quux := new_package_with_version("quux", "5.0-r0")
+	return []Package{foo, bar, baz, qux, quux}
+}
+
+func TestSelectPackages(t *testing.T) {
+	tests := []struct {
+		name string
+		sel  Selection
+		want []string
+	}{
+		{"all", new_selection(nil, nil, false, false, false), []string{"foo", "bar", "baz", "qux", "quux"}},
+		{"no dependencies", new_selection([]string{"baz"}, nil, false, false, false), []string{"baz"}},
+		{"glob", new_selection([]string{"ba*"}, nil, false, false, false), []string{"bar", "baz"}},
+		{"with deps", new_selection([]string{"foo"}, nil, true, false, false), []string{"foo", "bar", "baz"}},
+		{"with rdeps", new_selection([]string{"baz"}, nil, false, true, false), []string{"baz", "bar", "foo", "qux"}},
+		{"with deps and rdeps", new_selection([]string{"bar"}, nil, true, true, false), []string{"bar", "baz", "foo", "qux"}},
+		{"exclude", new_selection(nil, []string{"qu*"}, false, false, false), []string{"foo", "bar", "baz"}},
+		{"exclude rdeps", new_selection([]string{"baz"}, []string{"qux"}, false, true, false), []string{"baz", "bar", "foo"}},
+	}
+	for _, test := range tests {
+		selected, err := select_packages(test_queue(), test.sel)
+		if (err != nil) {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		names := []string{}
+		for _, pkg := range selected {
+			names = append(names, pkg.Name)
+		}
+		if (reflect.DeepEqual(names, test.want) == false) {
+			t.Errorf("%s: got %q, want %q", test.name, names, test.want)
+		}
+	}
+}
+
+func TestSelectPackagesStaleDependency(t *testing.T) {
+	tests := []struct {
+		name string
+		sel  Selection
+	}{
+		{"without deps", new_selection([]string{"foo"}, nil, false, false, false)},
+		{"excluded dependency", new_selection([]string{"foo"}, []string{"baz"}, true, false, false)},
+		{"excluded only", new_selection(nil, []string{"bar"}, false, false, false)},
+	}
+	for _, test := range tests {
+		_, err := select_packages(test_queue(), test.sel)
+		if (err == nil) {
+			t.Errorf("%s: expected an error for a dependency that is not selected", test.name)
+		}
+	}
+}
+
+func TestCheckSelection(t *testing.T) {
+	tests := []struct {
+		name  string
+		sel   Selection
+		valid bool
+	}{
+		{"match", new_selection([]string{"foo", "b*"}, []string{"qux"}, false, false, false), true},
+		{"no match", new_selection([]string{"fo"}, nil, false, false, false), false},
+		{"invalid only", new_selection([]string{"[foo"}, nil, false, false, false), false},
+		{"invalid exclude", new_selection(nil, []string{"[foo"}, false, false, false), false},
+	}
+	for _, test := range tests {
+		err := check_selection(test.sel, test_queue())
+		if ((err == nil) != test.valid) {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
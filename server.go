@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The status page. It is kept minimal; the JSON endpoints have everything.
+var status_page = template.Must(template.New("status").Funcs(template.FuncMap{
+	"log_url": log_url,
+	"since": func(t time.Time) string { return time.Since(t).Round(time.Second).String() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>simple-builder</title></head>
+<body>
+<h1>simple-builder is {{.Status.Activity}}</h1>
+{{if .Status.Trigger}}<p>Last run: {{.Status.Trigger}}, started {{since .Status.Started}} ago</p>{{end}}
+{{if .Status.Error}}<p><strong>Error:</strong> {{.Status.Error}}</p>{{end}}
+{{with .Status.Building}}<h2>Building</h2>
+<p>{{.Name}} {{.Version}} for {{.Repository}}, started {{since .Started}} ago</p>{{end}}
+<h2>Queue</h2>
+{{if .Status.Queue}}<ul>{{range .Status.Queue}}<li>{{.Name}} {{.Version}} - {{.Message}}</li>{{end}}</ul>{{else}}<p>Empty</p>{{end}}
+<h2>Recent runs</h2>
+{{if .Runs}}<ul>{{range .Runs}}<li>{{.Started.Format "2006-01-02 15:04:05"}} {{.Target}} {{.Result}}<ul>
+{{range .Packages}}<li>{{.Name}} {{.Version}} {{.Result}}{{with log_url .Log}} (<a href="{{.}}">log</a>){{end}}</li>{{end}}
+</ul></li>{{end}}</ul>{{else}}<p>No runs recorded</p>{{end}}
+{{if .Trigger}}<form method="post" action="/api/trigger"><input type="password" name="token" placeholder="API token" required> <button>Start a run</button></form>{{end}}
+</body>
+</html>
+`))
+
+// Serve the Status of the builder and the history over HTTP, and accept
+// Triggers. Webhooks are only accepted if a secret is given, and runs are
+// only started through the API with the token. Blocks until an error occurs.
+func serve_status(address, state_dir string, triggers chan<- Trigger, webhook WebhookOptions, token []byte) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handle_status_page(state_dir, len(token) != 0))
+	mux.HandleFunc("/api/status", handle_status)
+	mux.HandleFunc("/api/plan", handle_plan)
+	mux.HandleFunc("/api/queue", handle_queue)
+	mux.HandleFunc("/api/history", handle_history(state_dir))
+	mux.Handle("/api/logs/", http.StripPrefix("/api/logs/", http.FileServer(http.Dir(path.Join(state_dir, "logs")))))
+	mux.HandleFunc("/api/trigger", handle_trigger(triggers, token))
+	mux.HandleFunc("/metrics", handle_metrics)
+	if (webhook.is_enabled() == true) {
+		mux.HandleFunc("/api/webhook", handle_webhook(triggers, webhook))
+	}
+
+	server := http.Server{
+		Addr: address,
+		Handler: mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout: time.Minute,
+		WriteTimeout: 5 * time.Minute,
+		IdleTimeout: 2 * time.Minute,
+	}
+
+	logger("server").Info("Listening", "address", address)
+	return server.ListenAndServe()
+}
+
+// Construct the URL of a build log. Logs are kept in the state folder, under
+// `logs/TARGET/`.
+func log_url(filename string) string {
+	if (filename == "") {
+		return ""
+	}
+	return "/api/logs/" + path.Base(path.Dir(filename)) + "/" + path.Base(filename)
+}
+
+// Write a value as JSON.
+func write_json(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Write an error as JSON.
+func write_json_error(w http.ResponseWriter, status int, message string) {
+	write_json(w, status, map[string]string{"error": message})
+}
+
+// Read the history as requested by query parameters: `repository` and
+// `architecture`, `package`, `failures`, and `last` (10 by default), as for
+// the history command.
+func query_history(state_dir string, r *http.Request) ([]Run, error) {
+	query := r.URL.Query()
+
+	last := 10
+	if (query.Get("last") != "") {
+		var err error
+		last, err = strconv.Atoi(query.Get("last"))
+		if (err != nil) {
+			return nil, fmt.Errorf("last must be a number")
+		}
+	}
+
+	target, err := history_target_name(query.Get("repository"), query.Get("architecture"))
+	if (err != nil) {
+		return nil, err
+	}
+
+	runs, err := read_history(history_filename(state_dir))
+	if (err != nil) {
+		return nil, err
+	}
+
+	return filter_history(runs, target, query.Get("package"), query.Get("failures") == "true", last), nil
+}
+
+// Handle `GET /`. The form to start a run is only shown if runs can be
+// started through the API.
+func handle_status_page(state_dir string, trigger bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if (r.URL.Path != "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		runs, err := query_history(state_dir, r)
+		if (err != nil) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		status_page.Execute(w, map[string]any{"Status": builder_status.snapshot(), "Runs": runs, "Trigger": trigger})
+	}
+}
+
+// Handle `GET /api/status`.
+func handle_status(w http.ResponseWriter, r *http.Request) {
+	write_json(w, http.StatusOK, builder_status.snapshot())
+}
+
+// Handle `GET /api/plan`.
+func handle_plan(w http.ResponseWriter, r *http.Request) {
+	write_json(w, http.StatusOK, builder_status.snapshot().Plan)
+}
+
+// Handle `GET /api/queue`.
+func handle_queue(w http.ResponseWriter, r *http.Request) {
+	write_json(w, http.StatusOK, builder_status.snapshot().Queue)
+}
+
+// Handle `GET /api/history`.
+func handle_history(state_dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runs, err := query_history(state_dir, r)
+		if (err != nil) {
+			write_json_error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		for i, _ := range runs {
+			for j, _ := range runs[i].Packages {
+				runs[i].Packages[j].Log = log_url(runs[i].Packages[j].Log)
+			}
+		}
+		write_json(w, http.StatusOK, runs)
+	}
+}
+
+// Check the token of a request, given as `Authorization: Bearer TOKEN` or as
+// a `token` parameter. Since a cross-site form cannot know the token, this
+// also protects against cross-site request forgery.
+func is_authorized(r *http.Request, token []byte) bool {
+	if (len(token) == 0) {
+		return false
+	}
+
+	given := r.PostForm.Get("token")
+	scheme, credentials, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if (found == true) && (strings.EqualFold(scheme, "Bearer") == true) {
+		given = strings.TrimSpace(credentials)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(given), token) == 1
+}
+
+// Handle `POST /api/trigger`. Without parameters, a run is started. Each
+// `package` parameter is instead rebuilt, even if the repository is up to
+// date. The API token is required.
+func handle_trigger(triggers chan<- Trigger, token []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodPost) {
+			w.Header().Set("Allow", http.MethodPost)
+			write_json_error(w, http.StatusMethodNotAllowed, "Use POST")
+			return
+		}
+
+		if (len(token) == 0) {
+			write_json_error(w, http.StatusForbidden, "Starting runs through the API requires -api-token or -webhook-secret")
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024 * 1024)
+		err := r.ParseForm()
+		if (err != nil) {
+			write_json_error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if (is_authorized(r, token) == false) {
+			logger("server").Warn("Rejected trigger", "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			write_json_error(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+
+		trigger := Trigger{Reason: "requested by " + r.RemoteAddr, Force: true}
+		for _, names := range r.Form["package"] {
+			for _, name := range strings.Split(names, ",") {
+				if (name != "") {
+					trigger.Packages = append(trigger.Packages, name)
+				}
+			}
+		}
+
+		if (send_trigger(triggers, trigger) == false) {
+			write_json_error(w, http.StatusServiceUnavailable, "Too many runs are pending")
+			return
+		}
+
+		// Forms from the status page expect to be sent back to it.
+		if (strings.Contains(r.Header.Get("Accept"), "text/html") == true) {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		write_json(w, http.StatusAccepted, map[string]any{"queued": true, "packages": trigger.Packages})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleTrigger(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header map[string]string
+		body   string
+		status int
+	}{
+		{"disabled", "", map[string]string{"Authorization": "Bearer "}, "", http.StatusForbidden},
+		{"missing", "s3cret", nil, "package=foo", http.StatusUnauthorized},
+		{"wrong bearer", "s3cret", map[string]string{"Authorization": "Bearer secret"}, "", http.StatusUnauthorized},
+		{"wrong parameter", "s3cret", nil, "token=secret", http.StatusUnauthorized},
+		{"bearer", "s3cret", map[string]string{"Authorization": "Bearer s3cret"}, "package=foo,bar", http.StatusAccepted},
+		{"parameter", "s3cret", map[string]string{"Accept": "text/html"}, "token=s3cret", http.StatusSeeOther},
+	}
+
+	for _, test := range tests {
+		triggers := make(chan Trigger, 1)
+
+		r := httptest.NewRequest(http.MethodPost, "/api/trigger", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for name, value := range test.header {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handle_trigger(triggers, []byte(test.token))(w, r)
+
+		if (w.Code != test.status) {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+
+		queued := (len(triggers) == 1)
+		if (queued != (test.status < 400)) {
+			t.Errorf("%s: queued %t", test.name, queued)
+		}
+	}
+}
+
+func TestCleanApiToken(t *testing.T) {
+	token := clean_api_token("", WebhookOptions{Secret: []byte("webhook")})
+	if (string(token) != "webhook") {
+		t.Errorf("got %q, want the webhook secret", token)
+	}
+
+	token = clean_api_token("", WebhookOptions{})
+	if (len(token) != 0) {
+		t.Errorf("got %q, want no token", token)
+	}
+}
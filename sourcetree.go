@@ -2,12 +2,12 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"os"
 	"path"
+	"strings"
 )
 
-// Walk a local directory to identify package sources.
+// Walk local directories to identify package sources.
 //
 // Package sources should be organized like:
 // ```
@@ -20,33 +20,92 @@ import (
 // Any files not matching `APKBUILD` are ignored.
 // Any directories not containing an `APKBUILD` file are ignored.
 // Any files directly under the root are ignored.
-func walk_package_sources(root string) ([]Package, error) {
+//
+// Package sources can also be nested, e.g. an aports tree organized like
+// `root/main/package1/APKBUILD`, if the depth is greater than 1. The name of
+// the directory containing a package source (e.g. `main`) is the section of a
+// Package.
+func walk_package_sources(roots []string, depth int) ([]Package, error) {
+	packages, problems, err := scan_package_sources(roots, depth)
+	if (err != nil) {
+		return nil, err
+	}
+
+	for _, problem := range problems {
+		logger("pkgsrc").Debug("Skipping", "problem", problem)
+	}
+
+	if (len(packages) == 0) {
+		return nil, errors.New("No packages found")
+	}
+
+	return packages, nil
+}
+
+// SourceError stores a problem with a directory that could not be parsed as a
+// package source.
+type SourceError struct {
+	Name string
+	Err  error
+}
+
+func (e SourceError) Error() string {
+	return e.Err.Error()
+}
+
+// Scan local directories for package sources. Directories that could not be
+// parsed as package sources are returned as problems.
+func scan_package_sources(roots []string, depth int) ([]Package, []SourceError, error) {
 	packages := []Package{}
+	problems := []SourceError{}
+
+	for _, root := range roots {
+		err := scan_directory(root, depth, &packages, &problems)
+		if (err != nil) {
+			return nil, nil, err
+		}
+	}
+
+	return packages, problems, nil
+}
 
-	members, err := os.ReadDir(root)
+// Scan a local directory for package sources, descending into directories
+// that don't contain an APKBUILD file up to some depth. Hidden directories are
+// ignored.
+func scan_directory(directory string, depth int, packages *[]Package, problems *[]SourceError) error {
+	members, err := os.ReadDir(directory)
 	if (err != nil) {
-		return nil, err
+		return err
 	}
 
 	for _, member := range members {
-		if (member.IsDir() == true) {
-			name := member.Name()
-			pkg := new_package(name)
+		name := member.Name()
+		if (member.IsDir() == false) || (strings.HasPrefix(name, ".") == true) {
+			continue
+		}
+		subdirectory := path.Join(directory, name)
 
-			err = find_apkbuild(&pkg, path.Join(root, name))
+		_, err = os.Stat(path.Join(subdirectory, "APKBUILD"))
+		if (err != nil) && (1 < depth) {
+			err = scan_directory(subdirectory, depth - 1, packages, problems)
 			if (err != nil) {
-				debug(fmt.Sprintf("DEBUG-PKGSRC:%s", err))
-			} else {
-				packages = append(packages, pkg)
-				debug(fmt.Sprintf("DEBUG-PKGSRC:Package %s found", name))
+				return err
 			}
+			continue
 		}
-	}
 
-	if (len(packages) == 0) {
-		return nil, errors.New("No packages found")
+		pkg := new_package(name)
+		pkg.Path = subdirectory
+		pkg.Section = path.Base(directory)
+
+		err = find_apkbuild(&pkg, pkg.Path)
+		if (err != nil) {
+			*problems = append(*problems, SourceError{name, err})
+		} else {
+			*packages = append(*packages, pkg)
+			logger("pkgsrc").Debug("Package found", "name", name, "section", pkg.Section)
+		}
 	}
 
-	return packages, nil
+	return nil
 }
-
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	status_building = "building"
+	status_built = "built"
+	status_pushed = "pushed"
+	status_failed = "failed"
+)
+
+var (
+	pattern_unsafe_filename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// State stores the history of builds and pushes for a target.
+type State struct {
+	Target  string   `json:"target"`
+	Records []Record `json:"records"`
+}
+
+// Record stores the status of a single build of a Package.
+type Record struct {
+	Name     string    `json:"name"`
+	Version  string    `json:"version"`
+	Status   string    `json:"status"`
+	Checksum string    `json:"checksum,omitempty"`
+	Started  time.Time `json:"started"`
+	Built    time.Time `json:"built"`
+	Pushed   time.Time `json:"pushed"`
+}
+
+// Construct a name for a target (i.e. a repository and architecture) that is
+// safe to use in filenames.
+func target_name(repo, arch string) string {
+	return pattern_unsafe_filename.ReplaceAllString(repo, "_") + arch
+}
+
+// Construct the state filename for a target.
+func state_filename(state_dir, target string) string {
+	return path.Join(state_dir, target + ".json")
+}
+
+// Construct the lock filename for a target.
+func lock_filename(state_dir, target string) string {
+	return path.Join(state_dir, target + ".lock")
+}
+
+// Acquire the lock of a target, so that two runs never build for the same
+// target at once. The lock file contains the PID of the holder. A lock that is
+// held by a process that no longer exists is taken over.
+func acquire_lock(filename string) error {
+	err := os.MkdirAll(path.Dir(filename), 0755)
+	if (err != nil) {
+		return err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if (err == nil) {
+			_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+			return errors.Join(err, file.Close())
+		} else if (errors.Is(err, fs.ErrExist) == false) {
+			return err
+		}
+
+		content, err := os.ReadFile(filename)
+		if (err != nil) {
+			return err
+		}
+
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if (err == nil) && (process_exists(pid) == true) {
+			return fmt.Errorf("%s is locked by process %d", path.Base(filename), pid)
+		}
+
+		logger("state").Warn("Removing stale lock", "file", filename)
+		err = os.Remove(filename)
+		if (err != nil) && (errors.Is(err, fs.ErrNotExist) == false) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("Cannot acquire %s", filename)
+}
+
+// Release the lock of a target.
+func release_lock(filename string) error {
+	return os.Remove(filename)
+}
+
+// Check if a process exists.
+func process_exists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if (err != nil) {
+		return false
+	}
+	return (process.Signal(syscall.Signal(0)) == nil)
+}
+
+// Load the State of a target. If there is no state file yet, start a new one.
+func load_state(filename, target string) (State, error) {
+	state := State{target, []Record{}}
+
+	content, err := os.ReadFile(filename)
+	if (errors.Is(err, fs.ErrNotExist) == true) {
+		return state, nil
+	} else if (err != nil) {
+		return state, err
+	}
+
+	err = json.Unmarshal(content, &state)
+	if (err != nil) {
+		return state, fmt.Errorf("Cannot parse state file %s: %s", filename, err)
+	}
+
+	return state, nil
+}
+
+// Load the State of a target, unless it was already loaded.
+func load_cached_state(states map[string]*State, filename, target string) (*State, error) {
+	state, ok := states[target]
+	if (ok == true) {
+		return state, nil
+	}
+
+	loaded, err := load_state(filename, target)
+	if (err != nil) {
+		return nil, err
+	}
+
+	states[target] = &loaded
+	return &loaded, nil
+}
+
+// Save the State of a target. The file is replaced atomically so that an
+// interrupted save does not lose the history.
+func save_state(filename string, state State) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if (err != nil) {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(filename), 0755)
+	if (err != nil) {
+		return err
+	}
+
+	err = os.WriteFile(filename + ".tmp", content, 0644)
+	if (err != nil) {
+		return err
+	}
+
+	return os.Rename(filename + ".tmp", filename)
+}
+
+// Find the latest Record for a Package.
+func (state *State) latest(name string) int {
+	for i := len(state.Records) - 1; i >= 0; i-- {
+		if (state.Records[i].Name == name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add a Record for a Package build that is starting.
+func (state *State) begin(pkg Package) int {
+	rec := Record{Name: pkg.Name, Version: pkg.Version, Status: status_building, Started: time.Now()}
+	state.Records = append(state.Records, rec)
+	return len(state.Records) - 1
+}
+
+// Check if any Package was built but not pushed.
+func (state *State) has_unpushed() bool {
+	for i, rec := range state.Records {
+		if (rec.Status == status_built) && (state.latest(rec.Name) == i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a Package was already built but not pushed. The artifact must
+// still exist and match the recorded checksum.
+func (state *State) is_built(pkg Package, filename string) bool {
+	i := state.latest(pkg.Name)
+	if (i == -1) {
+		return false
+	}
+
+	rec := state.Records[i]
+	if (rec.Status != status_built) || (rec.Version != pkg.Version) {
+		return false
+	}
+
+	checksum, err := checksum_file(filename)
+	if (err != nil) {
+		logger("state").Debug("Cannot verify build", "error", err)
+		return false
+	}
+
+	return (checksum == rec.Checksum)
+}
+
+// Compute the checksum of a file.
+func checksum_file(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if (err != nil) {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if (err != nil) {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
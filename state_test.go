@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHasUnpushed(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []Record
+		want    bool
+	}{
+		{"empty", []Record{}, false},
+		{"built", []Record{{Name: "foo", Version: "1.0-r0", Status: status_built}}, true},
+		{"pushed", []Record{{Name: "foo", Version: "1.0-r0", Status: status_pushed}}, false},
+		{"pushed later", []Record{{Name: "foo", Version: "1.0-r0", Status: status_built}, {Name: "foo", Version: "1.0-r0", Status: status_pushed}}, false},
+		{"failed later", []Record{{Name: "foo", Version: "1.0-r0", Status: status_built}, {Name: "foo", Version: "1.1-r0", Status: status_failed}}, false},
+		{"other package", []Record{{Name: "foo", Version: "1.0-r0", Status: status_built}, {Name: "bar", Version: "1.0-r0", Status: status_pushed}}, true},
+		{"interrupted", []Record{{Name: "foo", Version: "1.0-r0", Status: status_building}}, false},
+	}
+	for _, test := range tests {
+		state := State{"host_var_pkgs_amd64", test.records}
+		if (state.has_unpushed() != test.want) {
+			t.Errorf("%s: got %t, want %t", test.name, state.has_unpushed(), test.want)
+		}
+	}
+}
+
+func TestIsBuilt(t *testing.T) {
+	filename := path.Join(t.TempDir(), "foo-1.0-r0.apk")
+	err := os.WriteFile(filename, []byte("apk"), 0644)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	checksum, err := checksum_file(filename)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	pkg := new_package_with_version("foo", "1.0-r0")
+
+	tests := []struct {
+		name     string
+		records  []Record
+		filename string
+		want     bool
+	}{
+		{"no record", []Record{}, filename, false},
+		{"built", []Record{{Name: "foo", Version: "1.0-r0", Status: status_built, Checksum: checksum}}, filename, true},
+		{"other version", []Record{{Name: "foo", Version: "0.9-r0", Status: status_built, Checksum: checksum}}, filename, false},
+		{"pushed", []Record{{Name: "foo", Version: "1.0-r0", Status: status_pushed, Checksum: checksum}}, filename, false},
+		{"rebuilt since", []Record{{Name: "foo", Version: "1.0-r0", Status: status_built, Checksum: checksum}, {Name: "foo", Version: "1.0-r0", Status: status_building}}, filename, false},
+		{"modified", []Record{{Name: "foo", Version: "1.0-r0", Status: status_built, Checksum: "sha256:00"}}, filename, false},
+		{"missing", []Record{{Name: "foo", Version: "1.0-r0", Status: status_built, Checksum: checksum}}, filename + ".missing", false},
+	}
+	for _, test := range tests {
+		state := State{"host_var_pkgs_amd64", test.records}
+		if (state.is_built(pkg, test.filename) != test.want) {
+			t.Errorf("%s: got %t, want %t", test.name, state.is_built(pkg, test.filename), test.want)
+		}
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	filename := state_filename(path.Join(t.TempDir(), "state"), "host_var_pkgs_amd64")
+
+	// A target without a state file starts empty.
+	state, err := load_state(filename, "host_var_pkgs_amd64")
+	if (err != nil) {
+		t.Fatal(err)
+	} else if (len(state.Records) != 0) {
+		t.Fatalf("got %d records, want 0", len(state.Records))
+	}
+
+	i := state.begin(new_package_with_version("foo", "1.0-r0"))
+	state.Records[i].Status = status_built
+	err = save_state(filename, state)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+
+	loaded, err := load_state(filename, "host_var_pkgs_amd64")
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	if (len(loaded.Records) != 1) || (loaded.Records[0].Name != "foo") || (loaded.Records[0].Status != status_built) {
+		t.Errorf("got %+v", loaded.Records)
+	}
+	if (loaded.has_unpushed() == false) {
+		t.Errorf("an interrupted run would not be resumed")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	activity_idle = "idle"
+	activity_planning = "planning"
+	activity_building = "building"
+)
+
+// Status stores what the builder is currently doing. It is updated as runs
+// progress, and read by the HTTP server.
+type Status struct {
+	mutex    *sync.Mutex
+	Activity string        `json:"activity"`
+	Trigger  string        `json:"trigger,omitempty"`
+	Started  time.Time     `json:"started"`
+	Plan     []StatusEntry `json:"plan"`
+	Building *StatusEntry  `json:"building,omitempty"`
+	Queue    []StatusEntry `json:"queue"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// StatusEntry stores a Package in the Status.
+type StatusEntry struct {
+	Name       string    `json:"name"`
+	Version    string    `json:"version"`
+	Message    string    `json:"message"`
+	Repository string    `json:"repository"`
+	Started    time.Time `json:"started"`
+}
+
+// The Status of this process.
+var builder_status = Status{mutex: &sync.Mutex{}, Activity: activity_idle, Plan: []StatusEntry{}, Queue: []StatusEntry{}}
+
+func new_status_entry(pkg Package) StatusEntry {
+	return StatusEntry{Name: pkg.Name, Version: pkg.Version, Message: pkg.Message, Repository: pkg.Repository}
+}
+
+// Record that a run was triggered and is being planned.
+func (status *Status) planning(trigger string) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	(*status).Activity = activity_planning
+	(*status).Trigger = trigger
+	(*status).Started = time.Now()
+	(*status).Building = nil
+	(*status).Queue = []StatusEntry{}
+	(*status).Error = ""
+}
+
+// Record the plan of a run. Every Package is queued.
+func (status *Status) planned(packages []Package) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	(*status).Plan = []StatusEntry{}
+	for _, pkg := range packages {
+		(*status).Plan = append((*status).Plan, new_status_entry(pkg))
+	}
+	(*status).Queue = append([]StatusEntry{}, (*status).Plan...)
+}
+
+// Record that a Package is being built, removing it from the queue.
+func (status *Status) building(pkg Package) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	(*status).Activity = activity_building
+	entry := new_status_entry(pkg)
+	entry.Started = time.Now()
+	(*status).Building = &entry
+
+	queue := []StatusEntry{}
+	for _, queued := range (*status).Queue {
+		if (queued.Name != pkg.Name) {
+			queue = append(queue, queued)
+		}
+	}
+	(*status).Queue = queue
+}
+
+// Record that a run finished. Packages that were not built (because of an
+// error) are no longer queued. An error, if any, is kept until the next run.
+func (status *Status) finished(err error) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	(*status).Activity = activity_idle
+	(*status).Building = nil
+	(*status).Queue = []StatusEntry{}
+	if (err != nil) {
+		(*status).Error = err.Error()
+	}
+}
+
+// Copy the Status, so that it can be read without holding the lock.
+func (status *Status) snapshot() Status {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	copied := Status{
+		Activity: (*status).Activity,
+		Trigger:  (*status).Trigger,
+		Started:  (*status).Started,
+		Plan:     append([]StatusEntry{}, (*status).Plan...),
+		Queue:    append([]StatusEntry{}, (*status).Queue...),
+		Error:    (*status).Error,
+	}
+	if ((*status).Building != nil) {
+		building := *(*status).Building
+		copied.Building = &building
+	}
+	return copied
+}
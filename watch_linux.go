@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watch_events = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// Watch package source directories with inotify, sending a trigger whenever a
+// file changes. Hidden files (e.g. editor swap files) are ignored. Blocks
+// until an error occurs.
+func watch_sources(roots []string, triggers chan<- Trigger) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if (err != nil) {
+		return fmt.Errorf("Cannot watch package sources: %s", err)
+	}
+	defer syscall.Close(fd)
+
+	err = add_watches(fd, roots)
+	if (err != nil) {
+		return err
+	}
+
+	buffer := make([]byte, 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1))
+	for {
+		n, err := syscall.Read(fd, buffer)
+		if (err == syscall.EINTR) {
+			continue
+		} else if (err != nil) {
+			return fmt.Errorf("Cannot watch package sources: %s", err)
+		}
+
+		changed := ""
+		for offset := 0; offset + syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			name_start := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buffer[name_start:name_start + int(event.Len)]), "\x00")
+			offset = name_start + int(event.Len)
+
+			if (name != "") && (strings.HasPrefix(name, ".") == false) {
+				changed = name
+			}
+		}
+
+		if (changed == "") {
+			continue
+		}
+		logger("watch").Debug("Changed", "file", changed)
+
+		// New directories need to be watched too. Adding a watch for a
+		// directory that is already watched has no effect.
+		err = add_watches(fd, roots)
+		if (err != nil) {
+			return err
+		}
+
+		send_trigger(triggers, Trigger{Reason: "source change"})
+	}
+}
+
+// Add an inotify watch for every directory under the roots, skipping hidden
+// directories.
+func add_watches(fd int, roots []string) error {
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(name string, entry os.DirEntry, err error) error {
+			if (err != nil) {
+				return err
+			}
+			if (entry.IsDir() == false) {
+				return nil
+			}
+			if (name != root) && (strings.HasPrefix(entry.Name(), ".") == true) {
+				return filepath.SkipDir
+			}
+
+			_, err = syscall.InotifyAddWatch(fd, name, watch_events)
+			if (err != nil) {
+				return fmt.Errorf("Cannot watch %s: %s", name, err)
+			}
+			return nil
+		})
+		if (err != nil) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Without inotify, package source directories are scanned at this interval.
+const watch_interval = 5 * time.Second
+
+// Watch package source directories by scanning them, sending a trigger
+// whenever a file changes. Hidden files (e.g. editor swap files) are ignored.
+// Blocks until an error occurs.
+func watch_sources(roots []string, triggers chan<- Trigger) error {
+	last, err := snapshot_sources(roots)
+	if (err != nil) {
+		return err
+	}
+
+	for {
+		time.Sleep(watch_interval)
+
+		current, err := snapshot_sources(roots)
+		if (err != nil) {
+			return err
+		}
+
+		if (current != last) {
+			logger("watch").Debug("Package sources changed")
+			send_trigger(triggers, Trigger{Reason: "source change"})
+			last = current
+		}
+	}
+}
+
+// Summarize the names, sizes, and modification times of every file under the
+// roots.
+func snapshot_sources(roots []string) (string, error) {
+	var snapshot strings.Builder
+
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(name string, entry os.DirEntry, err error) error {
+			if (err != nil) {
+				return err
+			}
+			if (name != root) && (strings.HasPrefix(entry.Name(), ".") == true) {
+				if (entry.IsDir() == true) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			info, err := entry.Info()
+			if (err != nil) {
+				return err
+			}
+			fmt.Fprintf(&snapshot, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+		if (err != nil) {
+			return "", fmt.Errorf("Cannot watch package sources: %s", err)
+		}
+	}
+
+	return snapshot.String(), nil
+}
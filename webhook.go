@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Payloads larger than this are rejected.
+const webhook_max_size = 16 * 1024 * 1024
+
+// WebhookOptions stores the secrets that webhooks are verified with. GitHub,
+// Gitea, and generic webhooks are signed with a shared secret (HMAC-SHA256).
+// sourcehut webhooks are signed with the private key of the sourcehut
+// instance (Ed25519). Pushes to refs other than Ref are ignored.
+type WebhookOptions struct {
+	Secret       []byte
+	SourcehutKey ed25519.PublicKey
+	Ref          string
+}
+
+// PushPayload stores the parts of a push webhook that are used. GitHub and
+// Gitea list the changed files of each commit. Generic webhooks can list
+// changed paths or packages directly.
+type PushPayload struct {
+	Ref      string       `json:"ref"`
+	Commits  []PushCommit `json:"commits"`
+	Paths    []string     `json:"paths"`
+	Packages []string     `json:"packages"`
+}
+
+// SourcehutPayload stores the parts of a sourcehut post-update webhook that
+// are used.
+type SourcehutPayload struct {
+	Refs []struct {
+		Name string `json:"name"`
+	} `json:"refs"`
+}
+
+// PushCommit stores the changed files of a commit in a push webhook.
+type PushCommit struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+// Check if any webhook secret was given.
+func (opts WebhookOptions) is_enabled() bool {
+	return (len(opts.Secret) != 0) || (len(opts.SourcehutKey) != 0)
+}
+
+// Check if a push to a ref should start a run. Generic webhooks may leave out
+// the ref.
+func (opts WebhookOptions) accepts_ref(ref string) bool {
+	return (opts.Ref == "") || (ref == "") || (ref == opts.Ref)
+}
+
+// Identify the forge that sent a webhook, and the event.
+func webhook_event(header http.Header) (string, string) {
+	if (header.Get("X-GitHub-Event") != "") {
+		return "github", header.Get("X-GitHub-Event")
+	} else if (header.Get("X-Gitea-Event") != "") {
+		return "gitea", header.Get("X-Gitea-Event")
+	} else if (header.Get("X-Forgejo-Event") != "") {
+		return "gitea", header.Get("X-Forgejo-Event")
+	} else if (header.Get("X-Payload-Signature") != "") {
+		return "sourcehut", header.Get("X-Webhook-Event")
+	}
+	return "generic", "push"
+}
+
+// Verify the signature of a webhook.
+func verify_webhook(forge string, header http.Header, body []byte, opts WebhookOptions) error {
+	if (forge == "sourcehut") {
+		if (len(opts.SourcehutKey) == 0) {
+			return errors.New("sourcehut webhooks are not accepted (no -webhook-sourcehut-key)")
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(header.Get("X-Payload-Signature"))
+		if (err != nil) {
+			return errors.New("Invalid signature")
+		}
+
+		message := append(append([]byte{}, body...), header.Get("X-Payload-Nonce")...)
+		if (ed25519.Verify(opts.SourcehutKey, message, signature) == false) {
+			return errors.New("Invalid signature")
+		}
+		return nil
+	}
+
+	if (len(opts.Secret) == 0) {
+		return fmt.Errorf("%s webhooks are not accepted (no -webhook-secret)", forge)
+	}
+
+	signature := header.Get("X-Hub-Signature-256")
+	if (forge == "gitea") {
+		signature = header.Get("X-Gitea-Signature")
+		if (signature == "") {
+			signature = header.Get("X-Forgejo-Signature")
+		}
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if (err != nil) || (len(expected) == 0) {
+		return errors.New("Invalid signature")
+	}
+
+	mac := hmac.New(sha256.New, opts.Secret)
+	mac.Write(body)
+	if (hmac.Equal(mac.Sum(nil), expected) == false) {
+		return errors.New("Invalid signature")
+	}
+	return nil
+}
+
+// Parse a verified webhook into a Trigger. Returns nil if the webhook should
+// be ignored, like a ping, a push to another branch, or a push that changed
+// no files.
+func parse_webhook(forge, event string, body []byte, opts WebhookOptions) (*Trigger, error) {
+	trigger := Trigger{Reason: forge + " webhook", Pull: true}
+
+	if (forge == "sourcehut") {
+		// sourcehut does not list the changed files, so every package
+		// source is checked.
+		if (event != "") && (event != "repo:post-update") && (event != "GIT_POST_RECEIVE") {
+			return nil, nil
+		}
+
+		payload := SourcehutPayload{}
+		err := json.Unmarshal(body, &payload)
+		if (err != nil) {
+			return nil, fmt.Errorf("Cannot parse webhook: %s", err)
+		}
+		for _, ref := range payload.Refs {
+			if (opts.accepts_ref(ref.Name) == true) {
+				return &trigger, nil
+			}
+		}
+		// A payload without refs cannot be checked.
+		if (len(payload.Refs) == 0) {
+			return &trigger, nil
+		}
+		return nil, nil
+	}
+
+	if (event != "push") {
+		return nil, nil
+	}
+
+	payload := PushPayload{}
+	err := json.Unmarshal(body, &payload)
+	if (err != nil) {
+		return nil, fmt.Errorf("Cannot parse webhook: %s", err)
+	}
+	if (opts.accepts_ref(payload.Ref) == false) {
+		return nil, nil
+	}
+
+	for _, commit := range payload.Commits {
+		for _, files := range [][]string{commit.Added, commit.Removed, commit.Modified} {
+			for _, name := range files {
+				if (find_string(&trigger.Paths, name) == -1) {
+					trigger.Paths = append(trigger.Paths, name)
+				}
+			}
+		}
+	}
+	trigger.Paths = append(trigger.Paths, payload.Paths...)
+	trigger.Packages = payload.Packages
+
+	// A generic webhook without paths or packages starts a full run.
+	if (forge != "generic") && (trigger.is_full() == true) {
+		return nil, nil
+	}
+
+	return &trigger, nil
+}
+
+// Handle `POST /api/webhook`. Package sources are pulled, and the package
+// sources containing changed files are built.
+func handle_webhook(triggers chan<- Trigger, opts WebhookOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodPost) {
+			w.Header().Set("Allow", http.MethodPost)
+			write_json_error(w, http.StatusMethodNotAllowed, "Use POST")
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, webhook_max_size + 1))
+		if (err != nil) {
+			write_json_error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if (len(body) > webhook_max_size) {
+			write_json_error(w, http.StatusRequestEntityTooLarge, "Payload is too large")
+			return
+		}
+
+		forge, event := webhook_event(r.Header)
+		err = verify_webhook(forge, r.Header, body, opts)
+		if (err != nil) {
+			logger("webhook").Warn("Rejected webhook", "forge", forge, "error", err)
+			write_json_error(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		trigger, err := parse_webhook(forge, event, body, opts)
+		if (err != nil) {
+			write_json_error(w, http.StatusBadRequest, err.Error())
+			return
+		} else if (trigger == nil) {
+			logger("webhook").Debug("Ignoring webhook", "forge", forge, "event", event)
+			write_json(w, http.StatusOK, map[string]any{"queued": false})
+			return
+		}
+
+		if (send_trigger(triggers, *trigger) == false) {
+			write_json_error(w, http.StatusServiceUnavailable, "Too many runs are pending")
+			return
+		}
+		write_json(w, http.StatusAccepted, map[string]any{"queued": true, "paths": (*trigger).Paths, "packages": (*trigger).Packages})
+	}
+}
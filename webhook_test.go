@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// The secrets that the recorded payloads in testdata/webhooks were signed
+// with.
+const (
+	test_webhook_secret = "It's a Secret to Everybody"
+	test_sourcehut_key = "A6EHv/POEL4dcN0Y50vAmWfk1jCbpQ1fHdyGZBJVMbg="
+)
+
+// WebhookTest stores a recorded webhook and the Trigger it should start, if
+// any.
+type WebhookTest struct {
+	name    string
+	payload string
+	header  map[string]string
+	paths   []string
+	queued  bool
+}
+
+var webhook_tests = []WebhookTest{
+	{
+		"github",
+		"github_push.json",
+		map[string]string{
+			"X-GitHub-Event": "push",
+			"X-Hub-Signature-256": "sha256=7666a6edbf00ed2c3b93f966fcc79a50e599365f0390d26ce0a704e60ede06b8",
+		},
+		[]string{"src/foo/APKBUILD", "src/bar/APKBUILD", "src/bar/bar.initd"},
+		true,
+	},
+	{
+		"github branch",
+		"github_push_branch.json",
+		map[string]string{
+			"X-GitHub-Event": "push",
+			"X-Hub-Signature-256": "sha256=9c964ec24de4b0122c4aab90f601a402d880a3a38d67bd47b67d8dcefb52538d",
+		},
+		nil,
+		false,
+	},
+	{
+		"gitea",
+		"gitea_push.json",
+		map[string]string{
+			"X-Gitea-Event": "push",
+			"X-Gitea-Signature": "7a10765ce667a330a03ec22202e317c785c8bcc1a3991422f6682d531f4ce35c",
+		},
+		[]string{"src/baz/fix-build.patch", "src/baz/APKBUILD"},
+		true,
+	},
+	{
+		"forgejo",
+		"gitea_push.json",
+		map[string]string{
+			"X-Forgejo-Event": "push",
+			"X-Forgejo-Signature": "7a10765ce667a330a03ec22202e317c785c8bcc1a3991422f6682d531f4ce35c",
+		},
+		[]string{"src/baz/fix-build.patch", "src/baz/APKBUILD"},
+		true,
+	},
+	{
+		"sourcehut",
+		"sourcehut_post_update.json",
+		map[string]string{
+			"X-Webhook-Event": "repo:post-update",
+			"X-Payload-Nonce": "9c3b6a2f1d4e",
+			"X-Payload-Signature": "y2DP4ONBnVjAOvfvuID+lMkRWpJxSuoa2vMpKffA8NJFazvmgos3IizUPevekA31IdhYvx2cgvC+TecDBHk4Cg==",
+		},
+		nil,
+		true,
+	},
+}
+
+func test_webhook_options(t *testing.T) WebhookOptions {
+	key, err := base64.StdEncoding.DecodeString(test_sourcehut_key)
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	return WebhookOptions{[]byte(test_webhook_secret), ed25519.PublicKey(key), "refs/heads/main"}
+}
+
+func read_webhook_payload(t *testing.T, name string) []byte {
+	body, err := os.ReadFile(path.Join("testdata", "webhooks", name))
+	if (err != nil) {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// Post a webhook to handle_webhook. Returns the status and the queued Trigger,
+// if any.
+func post_webhook(t *testing.T, opts WebhookOptions, header map[string]string, body []byte) (int, *Trigger) {
+	triggers := make(chan Trigger, 1)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/webhook", bytes.NewReader(body))
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handle_webhook(triggers, opts)(w, r)
+
+	select {
+	case trigger := <-triggers:
+		return w.Code, &trigger
+	default:
+		return w.Code, nil
+	}
+}
+
+func TestWebhookValid(t *testing.T) {
+	opts := test_webhook_options(t)
+
+	for _, test := range webhook_tests {
+		status, trigger := post_webhook(t, opts, test.header, read_webhook_payload(t, test.payload))
+		if (test.queued == false) {
+			// Pushes to other branches are ignored, like pings.
+			if (status != http.StatusOK) || (trigger != nil) {
+				t.Errorf("%s: got status %d, want %d and no run", test.name, status, http.StatusOK)
+			}
+			continue
+		} else if (status != http.StatusAccepted) {
+			t.Errorf("%s: got status %d, want %d", test.name, status, http.StatusAccepted)
+			continue
+		} else if (trigger == nil) {
+			t.Errorf("%s: no run was queued", test.name)
+			continue
+		}
+
+		if (reflect.DeepEqual((*trigger).Paths, test.paths) == false) {
+			t.Errorf("%s: got paths %q, want %q", test.name, (*trigger).Paths, test.paths)
+		}
+		if ((*trigger).Pull == false) {
+			t.Errorf("%s: package sources would not be pulled", test.name)
+		}
+	}
+}
+
+func TestWebhookTamperedPayload(t *testing.T) {
+	opts := test_webhook_options(t)
+
+	for _, test := range webhook_tests {
+		body := bytes.Replace(read_webhook_payload(t, test.payload), []byte("refs/heads/"), []byte("refs/heads/evil-"), 1)
+		status, trigger := post_webhook(t, opts, test.header, body)
+		if (status != http.StatusUnauthorized) || (trigger != nil) {
+			t.Errorf("%s: got status %d for a tampered payload, want %d", test.name, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestWebhookTamperedSignature(t *testing.T) {
+	opts := test_webhook_options(t)
+
+	for _, test := range webhook_tests {
+		header := map[string]string{}
+		for name, value := range test.header {
+			header[name] = value
+		}
+
+		switch test.name {
+		case "github", "github branch":
+			header["X-Hub-Signature-256"] = "sha256=0666a6edbf00ed2c3b93f966fcc79a50e599365f0390d26ce0a704e60ede06b8"
+		case "gitea":
+			header["X-Gitea-Signature"] = ""
+		case "forgejo":
+			header["X-Forgejo-Signature"] = "not hex"
+		case "sourcehut":
+			// The nonce is part of the signed message.
+			header["X-Payload-Nonce"] = "9c3b6a2f1d4f"
+		}
+
+		status, trigger := post_webhook(t, opts, header, read_webhook_payload(t, test.payload))
+		if (status != http.StatusUnauthorized) || (trigger != nil) {
+			t.Errorf("%s: got status %d for a tampered signature, want %d", test.name, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestWebhookWrongSecret(t *testing.T) {
+	other := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	opts := WebhookOptions{[]byte("another secret"), other, "refs/heads/main"}
+
+	for _, test := range webhook_tests {
+		status, _ := post_webhook(t, opts, test.header, read_webhook_payload(t, test.payload))
+		if (status != http.StatusUnauthorized) {
+			t.Errorf("%s: got status %d with the wrong secret, want %d", test.name, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestWebhookNotAccepted(t *testing.T) {
+	for _, test := range webhook_tests {
+		status, _ := post_webhook(t, WebhookOptions{}, test.header, read_webhook_payload(t, test.payload))
+		if (status != http.StatusUnauthorized) {
+			t.Errorf("%s: got status %d without secrets, want %d", test.name, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestWebhookIgnoredEvent(t *testing.T) {
+	opts := test_webhook_options(t)
+
+	test := webhook_tests[0]
+	header := map[string]string{}
+	for name, value := range test.header {
+		header[name] = value
+	}
+	header["X-GitHub-Event"] = "ping"
+
+	status, trigger := post_webhook(t, opts, header, read_webhook_payload(t, test.payload))
+	if (status != http.StatusOK) || (trigger != nil) {
+		t.Errorf("got status %d for a ping, want %d and no run", status, http.StatusOK)
+	}
+}
+
+func TestWebhookRef(t *testing.T) {
+	opts := test_webhook_options(t)
+	opts.Ref = "refs/heads/wip"
+
+	for _, test := range webhook_tests {
+		status, _ := post_webhook(t, opts, test.header, read_webhook_payload(t, test.payload))
+		if (test.queued == false) && (status != http.StatusAccepted) {
+			t.Errorf("%s: got status %d for a push to -webhook-ref, want %d", test.name, status, http.StatusAccepted)
+		} else if (test.queued == true) && (status != http.StatusOK) {
+			t.Errorf("%s: got status %d for a push to another branch, want %d", test.name, status, http.StatusOK)
+		}
+	}
+}